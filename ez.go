@@ -1,12 +1,20 @@
 package ez
 
 import (
+	"encoding"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"reflect"
+	"regexp"
+	"regexp/syntax"
 	"runtime"
+	"sort"
+	"strconv"
 	"strings"
+	"unicode"
 	"unicode/utf8"
 )
 
@@ -21,6 +29,20 @@ const (
 
 	callAction = "Call"
 
+	triviaAction = "Trivia"
+	lexemeAction = "Lexeme"
+	tokenAction  = "Token"
+
+	operatorsAction  = "Operators"
+	opLeftAction     = "Operators.Left"
+	opRightAction    = "Operators.Right"
+	opNonAssocAction = "Operators.NonAssoc"
+	opPrefixAction   = "Operators.Prefix"
+	opPostfixAction  = "Operators.Postfix"
+	opTernaryAction  = "Operators.Ternary"
+	opAtomAction     = "Operators.Atom"
+	opSpaceAction    = "Operators.Space"
+
 	cornerAction   = "Corner"
 	noCornerAction = "NoCorner"
 
@@ -41,6 +63,19 @@ const (
 	rejectAction    = "Reject"
 	captureAction   = "Capture"
 
+	bindAction    = "Bind"
+	backrefAction = "Backref"
+
+	countAction             = "Count"
+	countHexAction          = "Count.Hex"
+	countBigEndianAction    = "Count.BigEndian"
+	countLittleEndianAction = "Count.LittleEndian"
+	takeAction              = "Take"
+
+	predicateAction = "Predicate"
+	matchAction     = "Match"
+	regexpAction    = "Regexp"
+
 	startOfFileAction = "StartOfFile"
 	endOfFileAction   = "EndOfFile"
 
@@ -54,6 +89,16 @@ const (
 	matchRuneAction   = "MatchRune"
 	matchStringAction = "MatchString"
 
+	runeRangeFoldAction   = "Rune.RangeFold"
+	stringFoldAction      = "StringFold"
+	matchStringFoldAction = "MatchStringFold"
+
+	runeClassAction         = "Rune.Class"
+	runeScriptAction        = "Rune.Script"
+	runeIdentStartAction    = "Rune.IdentStart"
+	runeIdentContinueAction = "Rune.IdentContinue"
+	runeWhitespaceAction    = "Rune.Whitespace"
+
 	spaceAction             = "Space"
 	tabAction               = "Tab"
 	whitespaceAction        = "Whitespace"
@@ -76,6 +121,93 @@ const (
 
 var ParseError = errors.New("failed to parse")
 
+// ParseFailure describes the furthest point the parser reached before
+// giving up, and errors.Is(err, ParseError) holds for it
+
+type ParseFailure struct {
+	Offset   int      // in bytes
+	Line     int      // starts at 1
+	Column   int      // starts at 1, counts runes (bytes in BinaryMode), and tabs up to the tabstop
+	Rules    []string // rules being parsed at Offset, outermost first
+	Expected []string // terminals that would have matched at Offset
+
+	buf       string
+	base      int
+	lineStart int
+	tabstop   int
+}
+
+func (e *ParseFailure) Error() string {
+	var msg string
+
+	switch len(e.Expected) {
+	case 0:
+		msg = "unexpected input"
+	case 1:
+		msg = "expected " + e.Expected[0]
+	default:
+		last := len(e.Expected) - 1
+		msg = "expected " + strings.Join(e.Expected[:last], ", ") + " or " + e.Expected[last]
+	}
+
+	if len(e.Rules) > 0 {
+		msg = fmt.Sprintf("%v in rule %q", msg, e.Rules[len(e.Rules)-1])
+	}
+
+	return fmt.Sprintf("line %v, col %v: %v", e.Line, e.Column, msg)
+}
+
+func (e *ParseFailure) Unwrap() error {
+	return ParseError
+}
+
+// Format returns the error message, followed by the line of input
+// and a caret pointing at the column where parsing failed
+
+func (e *ParseFailure) Format() string {
+	// when reading, the start of the line may be gone
+	buf := e.buf
+	lineStart := e.lineStart - e.base
+	offset := e.Offset - e.base
+	if lineStart < 0 {
+		lineStart = 0
+	}
+
+	lineEnd := lineStart
+	for lineEnd < len(buf) && buf[lineEnd] != '\n' && buf[lineEnd] != '\r' {
+		lineEnd++
+	}
+
+	tabstop := e.tabstop
+	if tabstop < 1 {
+		tabstop = 1
+	}
+
+	var line strings.Builder
+	width := 0
+	caret := 0
+
+	for i, r := range buf[lineStart:lineEnd] {
+		if lineStart+i <= offset {
+			caret = width
+		}
+		if r == '\t' {
+			n := tabstop - (width % tabstop)
+			line.WriteString(strings.Repeat(" ", n))
+			width += n
+		} else {
+			line.WriteRune(r)
+			width += 1
+		}
+	}
+
+	if offset >= lineEnd {
+		caret = width
+	}
+
+	return fmt.Sprintf("%v\n%v\n%v^", e.Error(), line.String(), strings.Repeat(" ", caret))
+}
+
 var Whitespace = []string{" ", "\t"}
 var Newline = []string{"\r\n", "\r", "\n"}
 
@@ -95,12 +227,16 @@ func TextMode() *textMode {
 			byteListAction,
 			byteStringAction,
 			matchByteAction,
+			countBigEndianAction,
+			countLittleEndianAction,
+			tokenAction,
 		},
 	}
 }
 func StringMode() *stringMode {
 	return &stringMode{
 		actionsDisabled: []string{
+			tokenAction,
 			indentedBlockAction,
 			offsideBlockAction,
 			indentAction,
@@ -123,10 +259,43 @@ func BinaryMode() *binaryMode {
 			endOfLineAction,
 			runeRangeAction,
 			runeExceptAction,
+			runeRangeFoldAction,
+			runeClassAction,
+			runeScriptAction,
+			runeIdentStartAction,
+			runeIdentContinueAction,
+			runeWhitespaceAction,
+			stringFoldAction,
+			matchStringFoldAction,
+			regexpAction,
 			indentedBlockAction,
 			offsideBlockAction,
 			indentAction,
 			dedentAction,
+			tokenAction,
+		},
+	}
+}
+
+// TokenMode parses the tokens from a Lexer, rather than the input itself,
+// so terminals like String() are replaced by Token()
+
+func TokenMode(lexer *Lexer) *tokenMode {
+	return &tokenMode{
+		lexer: lexer,
+		actionsDisabled: []string{
+			triviaAction, lexemeAction,
+			runeAction, runeRangeAction, runeExceptAction, runeRangeFoldAction,
+			runeClassAction, runeScriptAction, runeIdentStartAction, runeIdentContinueAction, runeWhitespaceAction,
+			stringAction, stringFoldAction,
+			matchRuneAction, matchStringAction, matchStringFoldAction,
+			matchAction, regexpAction,
+			bindAction, backrefAction,
+			countAction, countHexAction, countBigEndianAction, countLittleEndianAction, takeAction,
+			spaceAction, tabAction, whitespaceAction, newlineAction, whitespaceNewlineAction,
+			startOfLineAction, endOfLineAction,
+			indentedBlockAction, offsideBlockAction, indentAction, dedentAction,
+			byteAction, byteRangeAction, byteExceptAction, matchByteAction, byteListAction, byteStringAction,
 		},
 	}
 }
@@ -136,6 +305,30 @@ func BuildGrammar(stub func(*G)) *Grammar {
 	return buildGrammar(pos, TextMode(), stub)
 }
 
+// BuildLexer builds a Lexer from the rules marked with .Token(), where
+// each rule is a kind of token, and Trivia() is skipped between them
+
+func BuildLexer(stub func(*G)) *Lexer {
+	pos := getCallerPosition(1, grammarAction)
+	grammar := buildGrammar(pos, TextMode(), func(g *G) {
+		g.lexer = true
+		if stub != nil {
+			stub(g)
+		}
+	})
+	if grammar.Err != nil {
+		return &Lexer{err: grammar.Err, parser: &Parser{err: grammar.Err}}
+	}
+
+	l := &Lexer{parser: grammar.Parser()}
+	for i, name := range grammar.config.names {
+		if grammar.rules[name].token && name != triviaRule {
+			l.kinds = append(l.kinds, i)
+		}
+	}
+	return l
+}
+
 func BuildParser(stub func(*G)) *Parser {
 	pos := getCallerPosition(1, grammarAction) // 1 is inside DefineGrammar, 2 is where DG was called
 	grammar := buildGrammar(pos, TextMode(), stub)
@@ -237,7 +430,28 @@ func (m *stringMode) grammarConfig() *grammarConfig {
 		name:            "string mode",
 		actionsDisabled: m.actionsDisabled,
 		tabstop:         1,
+		runeColumns:     true,
+	}
+}
+
+type tokenMode struct {
+	lexer           *Lexer
+	actionsDisabled []string
+}
+
+func (m *tokenMode) grammarConfig() *grammarConfig {
+	c := &grammarConfig{
+		name:            "token mode",
+		actionsDisabled: m.actionsDisabled,
+		tabstop:         1,
+		lexer:           m.lexer,
 	}
+	if m.lexer != nil && m.lexer.parser.config != nil {
+		c.tabstop = m.lexer.parser.config.tabstop
+		c.textMode = m.lexer.parser.config.textMode
+		c.runeColumns = m.lexer.parser.config.runeColumns
+	}
+	return c
 }
 
 type textMode struct {
@@ -252,6 +466,8 @@ func (m *textMode) grammarConfig() *grammarConfig {
 		actionsDisabled: m.actionsDisabled,
 		stringsReserved: m.stringsReserved,
 		tabstop:         m.tabstop,
+		textMode:        true,
+		runeColumns:     true,
 	}
 }
 
@@ -287,10 +503,20 @@ type parseAction struct {
 	//
 
 	recursiveNames []string
+	memo           bool
+	token          bool // trivia is skipped before the rule, but not inside
+	predicates     bool // the rule can call a Predicate, which sees the capture
 
 	precedence int
+
+	predicate func(*MatchContext) bool
+	matcher   func(string, int) (int, bool)
+	re        *regexp.Regexp // anchored at the start
 }
 
+// walk visits the arguments and the cases of MatchString, MatchRune,
+// or MatchByte before the action itself
+
 func (a *parseAction) walk(stub func(*parseAction)) {
 	if a == nil {
 		return
@@ -300,6 +526,15 @@ func (a *parseAction) walk(stub func(*parseAction)) {
 			c.walk(stub)
 		}
 	}
+	for _, c := range a.stringSwitch {
+		c.walk(stub)
+	}
+	for _, c := range a.runeSwitch {
+		c.walk(stub)
+	}
+	for _, c := range a.byteSwitch {
+		c.walk(stub)
+	}
 	stub(a)
 }
 
@@ -319,10 +554,10 @@ func (a *parseAction) leftCalls() []string {
 		return out
 
 	case traceAction,
-		doAction, caseAction, ruleAction, sequenceAction,
+		doAction, caseAction, ruleAction, sequenceAction, lexemeAction,
 		optionalAction, repeatAction,
-		lookaheadAction, captureAction, rejectAction,
-		matchRuneAction, matchStringAction, matchByteAction:
+		lookaheadAction, captureAction, rejectAction, bindAction,
+		matchRuneAction, matchStringAction, matchStringFoldAction, matchByteAction:
 
 		out := []string{}
 		for _, v := range a.args {
@@ -370,7 +605,7 @@ func (a *parseAction) setTerminal() {
 	case noCornerAction:
 		a.terminal = true
 
-	case doAction, sequenceAction, caseAction, ruleAction:
+	case doAction, sequenceAction, caseAction, ruleAction, lexemeAction:
 		a.terminal = allTerminal
 	case choiceAction:
 		a.terminal = allTerminal
@@ -386,8 +621,20 @@ func (a *parseAction) setTerminal() {
 		a.terminal = allTerminal
 	case captureAction:
 		a.terminal = allTerminal
+	case bindAction:
+		a.terminal = allTerminal
+	case backrefAction:
+		a.terminal = true
+	case countAction, countHexAction, countBigEndianAction, countLittleEndianAction:
+		a.terminal = true
+	case takeAction:
+		a.terminal = true
+	case predicateAction:
+		a.terminal = true
+	case matchAction, regexpAction, tokenAction:
+		a.terminal = true
 
-	case matchRuneAction, matchStringAction:
+	case matchRuneAction, matchStringAction, matchStringFoldAction:
 		a.terminal = allTerminal
 	case matchByteAction:
 		a.terminal = allTerminal
@@ -397,9 +644,11 @@ func (a *parseAction) setTerminal() {
 	case startOfLineAction, endOfLineAction:
 		a.terminal = true
 
-	case runeAction, stringAction:
+	case runeAction, stringAction, stringFoldAction:
+		a.terminal = true
+	case runeRangeAction, runeExceptAction, runeRangeFoldAction:
 		a.terminal = true
-	case runeRangeAction, runeExceptAction:
+	case runeClassAction, runeScriptAction, runeIdentStartAction, runeIdentContinueAction, runeWhitespaceAction:
 		a.terminal = true
 
 	case spaceAction, tabAction:
@@ -451,24 +700,38 @@ func (a *parseAction) setZeroWidth(rules map[string]bool) bool {
 	case cornerAction, noCornerAction:
 		a.zeroWidth = true
 
-	case doAction, caseAction, ruleAction, sequenceAction:
+	case doAction, caseAction, ruleAction, sequenceAction, lexemeAction:
 		a.zeroWidth = allZw
 	case choiceAction:
 		a.zeroWidth = anyZw
 	case cutAction:
 		a.zeroWidth = true
 	case repeatAction:
-		a.zeroWidth = a.min == 0 || allZw
+		a.zeroWidth = a.min == 0 || a.name != "" || allZw
 	case lookaheadAction:
 		a.zeroWidth = true
 	case rejectAction:
 		a.zeroWidth = true
 	case captureAction:
 		a.zeroWidth = allZw
+	case bindAction:
+		a.zeroWidth = allZw
+	case backrefAction:
+		a.zeroWidth = true // can be bound to an empty string
+	case countAction, countHexAction, countBigEndianAction, countLittleEndianAction:
+		a.zeroWidth = false
+	case takeAction:
+		a.zeroWidth = true // can take zero
+	case predicateAction:
+		a.zeroWidth = true
+	case matchAction, tokenAction:
+		a.zeroWidth = false
+	case regexpAction:
+		a.zeroWidth = a.min == 0
 	case optionalAction:
 		a.zeroWidth = true
 
-	case matchStringAction:
+	case matchStringAction, matchStringFoldAction:
 		allZw = true
 		anyZw = false
 		if a.stringSwitch != nil {
@@ -522,7 +785,11 @@ func (a *parseAction) setZeroWidth(rules map[string]bool) bool {
 
 	case runeAction, stringAction:
 		a.zeroWidth = false
-	case runeRangeAction, runeExceptAction:
+	case runeRangeAction, runeExceptAction, runeRangeFoldAction:
+		a.zeroWidth = false
+	case runeClassAction, runeScriptAction, runeIdentStartAction, runeIdentContinueAction, runeWhitespaceAction:
+		a.zeroWidth = false
+	case stringFoldAction:
 		a.zeroWidth = false
 
 	case spaceAction, tabAction:
@@ -550,6 +817,245 @@ func (a *parseAction) setZeroWidth(rules map[string]bool) bool {
 	return old != a.zeroWidth
 }
 
+// captureShape describes the captures an action can produce: how many,
+// and when it's always the same sequence, their names. max < 0 means
+// there is no upper bound
+
+type captureShape struct {
+	min   int
+	max   int
+	names []string
+	exact bool
+}
+
+var unknownShape = captureShape{min: 0, max: -1}
+
+func (c captureShape) then(o captureShape) captureShape {
+	out := captureShape{min: c.min + o.min, max: c.max + o.max}
+	if c.max < 0 || o.max < 0 {
+		out.max = -1
+	}
+	if c.exact && o.exact {
+		out.exact = true
+		out.names = append(append([]string{}, c.names...), o.names...)
+	}
+	return out
+}
+
+func (c captureShape) or(o captureShape) captureShape {
+	out := captureShape{min: c.min, max: c.max}
+	if o.min < out.min {
+		out.min = o.min
+	}
+	if out.max >= 0 && (o.max < 0 || o.max > out.max) {
+		out.max = o.max
+	}
+	if c.exact && o.exact && len(c.names) == len(o.names) {
+		out.exact = true
+		out.names = c.names
+		for i, n := range o.names {
+			if c.names[i] != n {
+				out.exact = false
+				out.names = nil
+				break
+			}
+		}
+	}
+	return out
+}
+
+func (c captureShape) String() string {
+	switch {
+	case c.min == c.max:
+		return fmt.Sprint(c.min)
+	case c.max < 0:
+		return fmt.Sprintf("at least %v", c.min)
+	default:
+		return fmt.Sprintf("%v to %v", c.min, c.max)
+	}
+}
+
+func (a *parseAction) captureShape(rules map[string]*parseAction, seen map[string]bool) captureShape {
+	empty := captureShape{exact: true}
+	seq := func(args []*parseAction) captureShape {
+		out := empty
+		for _, c := range args {
+			out = out.then(c.captureShape(rules, seen))
+		}
+		return out
+	}
+
+	switch a.kind {
+	case captureAction:
+		return captureShape{min: 1, max: 1, names: []string{a.name}, exact: true}
+	case lookaheadAction, rejectAction:
+		return empty
+	case callAction:
+		rule := rules[a.name]
+		if rule == nil || seen[a.name] || len(rule.recursiveNames) > 0 {
+			return unknownShape
+		}
+		seen[a.name] = true
+		out := rule.captureShape(rules, seen)
+		seen[a.name] = false
+		return out
+	case recurAction, stumpAction, cornerAction, noCornerAction:
+		return unknownShape
+	case choiceAction:
+		if len(a.args) == 0 {
+			return empty
+		}
+		out := a.args[0].captureShape(rules, seen)
+		for _, c := range a.args[1:] {
+			out = out.or(c.captureShape(rules, seen))
+		}
+		return out
+	case matchStringAction, matchStringFoldAction, matchRuneAction, matchByteAction:
+		var cases []*parseAction
+		for _, c := range a.stringSwitch {
+			cases = append(cases, c)
+		}
+		for _, c := range a.runeSwitch {
+			cases = append(cases, c)
+		}
+		for _, c := range a.byteSwitch {
+			cases = append(cases, c)
+		}
+		if len(cases) == 0 {
+			return empty
+		}
+		out := cases[0].captureShape(rules, seen)
+		for _, c := range cases[1:] {
+			out = out.or(c.captureShape(rules, seen))
+		}
+		return out
+	case optionalAction:
+		return empty.or(seq(a.args))
+	case repeatAction:
+		body := seq(a.args)
+		if body.max == 0 {
+			return empty
+		}
+		if a.name != "" || a.max == 0 || body.max < 0 {
+			return captureShape{min: body.min * a.min, max: -1}
+		}
+		out := captureShape{min: body.min * a.min, max: body.max * a.max}
+		if a.min == a.max && body.exact {
+			out.exact = true
+			for i := 0; i < a.min; i++ {
+				out.names = append(out.names, body.names...)
+			}
+		}
+		return out
+	default:
+		return seq(a.args)
+	}
+}
+
+// expected describes what a terminal matches, for error messages
+
+func (a *parseAction) expected() []string {
+	switch a.kind {
+	case stringAction:
+		out := make([]string, len(a.strings))
+		for i, v := range a.strings {
+			out[i] = fmt.Sprintf("%q", v)
+		}
+		return out
+	case byteListAction, byteStringAction:
+		out := make([]string, len(a.bytes))
+		for i, v := range a.bytes {
+			out[i] = fmt.Sprintf("%q", v)
+		}
+		return out
+	case matchStringAction:
+		out := make([]string, 0, len(a.stringSwitch))
+		for k := range a.stringSwitch {
+			out = append(out, fmt.Sprintf("%q", k))
+		}
+		sort.Strings(out)
+		return out
+	case stringFoldAction:
+		out := make([]string, len(a.strings))
+		for i, v := range a.strings {
+			out[i] = fmt.Sprintf("%q ignoring case", v)
+		}
+		return out
+	case matchStringFoldAction:
+		out := make([]string, 0, len(a.stringSwitch))
+		for k := range a.stringSwitch {
+			out = append(out, fmt.Sprintf("%q ignoring case", k))
+		}
+		sort.Strings(out)
+		return out
+	case runeRangeFoldAction:
+		return []string{"[" + strings.Join(a.ranges, "") + "] ignoring case"}
+	case runeClassAction, runeScriptAction:
+		out := "["
+		for _, v := range a.strings {
+			out += `\p{` + v + "}"
+		}
+		return []string{out + "]"}
+	case runeIdentStartAction:
+		return []string{"identifier start"}
+	case runeIdentContinueAction:
+		return []string{"identifier character"}
+	case runeWhitespaceAction:
+		return []string{"whitespace"}
+	case matchRuneAction:
+		out := make([]string, 0, len(a.runeSwitch))
+		for k := range a.runeSwitch {
+			out = append(out, fmt.Sprintf("%q", k))
+		}
+		sort.Strings(out)
+		return out
+	case matchByteAction:
+		out := make([]string, 0, len(a.byteSwitch))
+		for k := range a.byteSwitch {
+			out = append(out, fmt.Sprintf("%q", k))
+		}
+		sort.Strings(out)
+		return out
+	case runeRangeAction, byteRangeAction:
+		return []string{"[" + strings.Join(a.ranges, "") + "]"}
+	case runeExceptAction, byteExceptAction:
+		return []string{"[^" + strings.Join(a.ranges, "") + "]"}
+	case matchAction:
+		return []string{a.name}
+	case tokenAction:
+		return a.strings
+	case regexpAction:
+		return []string{"/" + a.strings[0] + "/"}
+	case runeAction:
+		return []string{"any character"}
+	case byteAction:
+		return []string{"any byte"}
+	case spaceAction:
+		return []string{`" "`}
+	case tabAction:
+		return []string{`"\t"`}
+	case newlineAction:
+		return []string{"newline"}
+	case startOfFileAction:
+		return []string{"start of file"}
+	case endOfFileAction:
+		return []string{"end of file"}
+	case startOfLineAction:
+		return []string{"start of line"}
+	case endOfLineAction:
+		return []string{"end of line"}
+	case indentAction:
+		return []string{"indentation"}
+	case countAction:
+		return []string{"[0-9]"}
+	case countHexAction:
+		return []string{"[0-9a-fA-F]"}
+	case countBigEndianAction, countLittleEndianAction:
+		return []string{fmt.Sprintf("%v byte integer", a.min)}
+	}
+	return nil
+}
+
 // Builder
 
 type nodeBuilder struct {
@@ -584,11 +1090,18 @@ type G struct {
 	Start   string
 	LogFunc func(string, ...any)
 
+	// cache the result of every rule that isn't left recursive,
+	// like Define(...).Memo()
+	Memo bool
+
 	Mode       GrammarMode
 	configmode GrammarMode
 
-	builderPos map[string]*filePosition
-	rulePos    map[string]*filePosition
+	builderPos   map[string]*filePosition
+	builderTypes map[string]reflect.Type // for builders with typed arguments
+	rulePos      map[string]*filePosition
+
+	lexer bool // building a Lexer, so Token() rules are all used
 
 	nb *nodeBuilder
 	//err    error
@@ -718,6 +1231,18 @@ func (db DefineOptions) Recursive(names ...string) DefineBlock {
 	return db.g.defineRecursive(db.name, db.p, db.a, names)
 }
 
+// Memo caches the result of the rule at each offset. The cache is
+// skipped while inside a Recursive() or Operators() rule, where the
+// result depends on the precedence too, and when tracing
+
+func (db DefineOptions) Memo() DefineOptions {
+	return db.g.defineMemo(db.name, db.p, db.a)
+}
+
+func (db DefineOptions) Token() DefineOptions {
+	return db.g.defineToken(db.name, db.p, db.a)
+}
+
 type DefineBlock struct {
 	name string
 	g    *G
@@ -761,6 +1286,50 @@ func (g *G) Define(name string) DefineOptions {
 	return do
 }
 
+// Trivia defines a rule called "trivia", for whitespace or comments, which
+// is skipped (as many times as it matches) before every terminal, Capture(),
+// and Token() rule. Lexeme() and Token() rules turn off skipping inside.
+// Whitespace terminals, like Newline() or Rune().Whitespace(), don't skip.
+
+func (g *G) Trivia(stub func()) {
+	p := g.markPosition(triviaAction)
+
+	if g.grammar == nil {
+		return
+	} else if g.nb == nil {
+		g.addError(p, "must call Trivia inside BuildGrammar()")
+		return
+	} else if g.nb.inRule() {
+		g.addError(p, "cant call Trivia() inside Define()")
+		return
+	} else if g.Mode == nil {
+		g.addError(p, "Mode must be set first")
+		return
+	} else if stub == nil {
+		g.addError(p, "cant call Trivia() with nil")
+		return
+	} else if config := g.grammarConfig(); !config.actionAllowed(triviaAction) {
+		g.addErrorf(p, "cannot call %v() in %v", triviaAction, config.name)
+		return
+	}
+
+	if oldPos, ok := g.rulePos[triviaRule]; ok {
+		g.addErrorf(p, "cant redefine %q, already defined at %v", triviaRule, oldPos)
+		return
+	}
+
+	g.rulePos[triviaRule] = p
+
+	a := &parseAction{kind: ruleAction, pos: p, token: true}
+	g.grammar.rules[triviaRule] = a
+	g.grammarConfig().names = append(g.grammarConfig().names, triviaRule)
+	g.grammarConfig().trivia = true
+
+	a.args = g.buildRule(triviaRule, stub)
+}
+
+const triviaRule = "trivia"
+
 func (g *G) defineSequence(name string, definePos *filePosition, a *parseAction, stub func()) {
 	p := g.markPosition(defineAction)
 
@@ -825,6 +1394,54 @@ func (g *G) defineChoice(name string, definePos *filePosition, a *parseAction, o
 	})
 }
 
+func (g *G) defineMemo(name string, definePos *filePosition, a *parseAction) DefineOptions {
+	p := g.markPosition(defineAction)
+
+	do := DefineOptions{g: g, a: a, p: p, name: name}
+
+	if a == nil || g.grammar == nil {
+		return do
+	} else if g.nb == nil {
+		g.addError(p, "must call Memo inside grammar")
+		return do
+	} else if g.nb.inRule() {
+		g.addError(p, "cant call Memo() inside a rule")
+		return do
+	}
+
+	if p.n-definePos.n != 1 {
+		g.addError(p, "called in wrong position")
+		return do
+	}
+
+	a.memo = true
+	return do
+}
+
+func (g *G) defineToken(name string, definePos *filePosition, a *parseAction) DefineOptions {
+	p := g.markPosition(defineAction)
+
+	do := DefineOptions{g: g, a: a, p: p, name: name}
+
+	if a == nil || g.grammar == nil {
+		return do
+	} else if g.nb == nil {
+		g.addError(p, "must call Token inside grammar")
+		return do
+	} else if g.nb.inRule() {
+		g.addError(p, "cant call Token() inside a rule")
+		return do
+	}
+
+	if p.n-definePos.n != 1 {
+		g.addError(p, "called in wrong position")
+		return do
+	}
+
+	a.token = true
+	return do
+}
+
 func (g *G) defineRecursive(name string, definePos *filePosition, a *parseAction, names []string) DefineBlock {
 	p := g.markPosition(defineAction)
 
@@ -1126,29 +1743,75 @@ func (g *G) MatchString(stubs map[string]func()) {
 	g.nb.append(a)
 }
 
-func (g *G) MatchRune(stubs map[rune]func()) {
-	p := g.markPosition(matchRuneAction)
-	if g.shouldExit(p, matchRuneAction) {
+// MatchStringFold is like MatchString, but ignores case, using
+// Unicode simple case folding. Like MatchString, it looks up as many
+// runes as the longest key has, so keys should be the same length
+
+func (g *G) MatchStringFold(stubs map[string]func()) {
+	p := g.markPosition(matchStringFoldAction)
+	if g.shouldExit(p, matchStringFoldAction) {
 		return
 	} else if stubs == nil {
-		g.addError(p, "cant call MatchRune() with nil map")
+		g.addError(p, "cant call MatchStringFold() with nil map")
 		return
 	}
 
-	args := make(map[rune]*parseAction, len(stubs))
+	args := make(map[string]*parseAction, len(stubs))
+	seen := make(map[string]string, len(stubs))
 	for c, stub := range stubs {
-		if stub == nil {
-			g.addError(p, "cant call MatchRune() with nil function")
-		} else {
-			stubArgs := g.buildArgs(matchRuneAction, stub)
-			args[c] = &parseAction{kind: caseAction, pos: p, args: stubArgs}
+		if !utf8.ValidString(c) {
+			g.addErrorf(p, "MatchStringFold(%q) contains invalid UTF-8", c)
+		} else if c == "" {
+			g.addErrorf(p, "MatchStringFold(%q) is empty string", c)
 		}
-	}
-	a := &parseAction{kind: matchRuneAction, runeSwitch: args, pos: p}
-	g.nb.append(a)
-}
 
-func (g *G) String(s ...string) {
+		for _, b := range g.grammarConfig().stringsReserved {
+			if strings.Index(c, b) > -1 {
+				g.addErrorf(p, "MatchStringFold(%q) contains reserved string %q", c, b)
+			}
+		}
+
+		key := foldString(c)
+		if old, ok := seen[key]; ok {
+			g.addErrorf(p, "MatchStringFold(%q) is the same as %q, ignoring case", c, old)
+		}
+		seen[key] = c
+
+		if stub == nil {
+			g.addError(p, "cant call MatchStringFold() with nil function")
+			return
+		} else {
+			stubArgs := g.buildArgs(matchStringFoldAction, stub)
+			args[key] = &parseAction{kind: caseAction, pos: p, args: stubArgs}
+		}
+	}
+	a := &parseAction{kind: matchStringFoldAction, stringSwitch: args, pos: p}
+	g.nb.append(a)
+}
+
+func (g *G) MatchRune(stubs map[rune]func()) {
+	p := g.markPosition(matchRuneAction)
+	if g.shouldExit(p, matchRuneAction) {
+		return
+	} else if stubs == nil {
+		g.addError(p, "cant call MatchRune() with nil map")
+		return
+	}
+
+	args := make(map[rune]*parseAction, len(stubs))
+	for c, stub := range stubs {
+		if stub == nil {
+			g.addError(p, "cant call MatchRune() with nil function")
+		} else {
+			stubArgs := g.buildArgs(matchRuneAction, stub)
+			args[c] = &parseAction{kind: caseAction, pos: p, args: stubArgs}
+		}
+	}
+	a := &parseAction{kind: matchRuneAction, runeSwitch: args, pos: p}
+	g.nb.append(a)
+}
+
+func (g *G) String(s ...string) {
 	p := g.markPosition(stringAction)
 	if g.shouldExit(p, stringAction) {
 		return
@@ -1175,6 +1838,36 @@ func (g *G) String(s ...string) {
 	g.nb.append(a)
 }
 
+// StringFold is like String, but ignores case, using Unicode simple
+// case folding
+
+func (g *G) StringFold(s ...string) {
+	p := g.markPosition(stringFoldAction)
+	if g.shouldExit(p, stringFoldAction) {
+		return
+	}
+	if len(s) == 0 {
+		g.addError(p, "missing operand")
+		return
+	}
+	for _, v := range s {
+		if !utf8.ValidString(v) {
+			g.addErrorf(p, "StringFold(%q) contains invalid UTF-8", v)
+		} else if v == "" {
+			g.addErrorf(p, "StringFold(%q) is empty string", v)
+		}
+		for _, b := range g.grammarConfig().stringsReserved {
+			if strings.Index(v, b) > -1 {
+				g.addErrorf(p, "StringFold(%q) contains reserved string %q", v, b)
+			}
+		}
+
+	}
+
+	a := &parseAction{kind: stringFoldAction, strings: s, pos: p}
+	g.nb.append(a)
+}
+
 func (g *G) MatchByte(stubs map[byte]func()) {
 	p := g.markPosition(matchByteAction)
 	if g.shouldExit(p, matchByteAction) {
@@ -1255,6 +1948,43 @@ func (ro RuneOption) Except(s ...string) {
 	ro.g.runeExcept(ro.p, ro.a, s)
 }
 
+// RangeFold is like Range, but ignores case
+
+func (ro RuneOption) RangeFold(s ...string) {
+	ro.g.runeRangeFold(ro.p, ro.a, s)
+}
+
+// Class matches runes in the given Unicode categories, like "L" or "Nd"
+
+func (ro RuneOption) Class(names ...string) {
+	ro.g.runeClass(ro.p, ro.a, runeClassAction, names)
+}
+
+// Script matches runes in the given Unicode scripts, like "Greek"
+
+func (ro RuneOption) Script(names ...string) {
+	ro.g.runeClass(ro.p, ro.a, runeScriptAction, names)
+}
+
+// IdentStart and IdentContinue match the runes that can start and
+// continue an identifier, as in Unicode Standard Annex #31
+
+func (ro RuneOption) IdentStart() {
+	ro.g.runeClass(ro.p, ro.a, runeIdentStartAction, nil)
+}
+
+func (ro RuneOption) IdentContinue() {
+	ro.g.runeClass(ro.p, ro.a, runeIdentContinueAction, nil)
+}
+
+// Whitespace matches any rune with the Unicode White_Space property.
+// In TextMode that includes "\r", "\n", and "\t", which are only
+// reserved for String() and other literals, so a "\r\n" is two matches
+
+func (ro RuneOption) Whitespace() {
+	ro.g.runeClass(ro.p, ro.a, runeWhitespaceAction, nil)
+}
+
 func (g *G) Rune() RuneOption {
 	p := g.markPosition(runeAction)
 	ro := RuneOption{g: g, p: p}
@@ -1295,6 +2025,94 @@ func (g *G) runeRange(repeatPos *filePosition, a *parseAction, s []string) {
 	*a = parseAction{kind: runeRangeAction, ranges: args, pos: p}
 }
 
+func (g *G) runeRangeFold(repeatPos *filePosition, a *parseAction, s []string) {
+	p := g.markPosition(runeRangeFoldAction)
+	if a == nil || g.shouldExit(p, runeRangeFoldAction) {
+		return
+	}
+
+	if p.n-repeatPos.n != 1 {
+		g.addError(p, "called in wrong position")
+		return
+	}
+
+	if len(s) == 0 {
+		g.addError(p, "missing operand")
+		return
+	}
+
+	args := make([]string, len(s))
+	for i, v := range s {
+		r := []rune(v)
+		if !(len(r) == 1 || (len(r) == 3 && r[1] == '-' && r[0] < r[2])) {
+			g.addError(p, "invalid range", v)
+		}
+		args[i] = v
+	}
+	*a = parseAction{kind: runeRangeFoldAction, ranges: args, pos: p}
+}
+
+func (g *G) runeClass(repeatPos *filePosition, a *parseAction, kind string, names []string) {
+	p := g.markPosition(kind)
+	if a == nil || g.shouldExit(p, kind) {
+		return
+	}
+
+	if p.n-repeatPos.n != 1 {
+		g.addError(p, "called in wrong position")
+		return
+	}
+
+	tables := unicode.Categories
+	if kind == runeScriptAction {
+		tables = unicode.Scripts
+	}
+
+	switch kind {
+	case runeClassAction, runeScriptAction:
+		if len(names) == 0 {
+			g.addError(p, "missing operand")
+			return
+		}
+		for _, v := range names {
+			if _, ok := tables[v]; !ok {
+				g.addErrorf(p, "%v(%q) is not a known name", kind, v)
+			}
+		}
+	}
+
+	*a = parseAction{kind: kind, strings: names, pos: p}
+}
+
+// the runes that can start or continue an identifier, from UAX #31
+
+var identStart = []*unicode.RangeTable{unicode.L, unicode.Nl, unicode.Other_ID_Start}
+var identContinue = []*unicode.RangeTable{
+	unicode.L, unicode.Nl, unicode.Other_ID_Start,
+	unicode.Mn, unicode.Mc, unicode.Nd, unicode.Pc, unicode.Other_ID_Continue,
+}
+var identExcluded = []*unicode.RangeTable{unicode.Pattern_Syntax, unicode.Pattern_White_Space}
+
+func runeClassTables(a *parseAction) (include []*unicode.RangeTable, exclude []*unicode.RangeTable) {
+	switch a.kind {
+	case runeClassAction:
+		for _, v := range a.strings {
+			include = append(include, unicode.Categories[v])
+		}
+	case runeScriptAction:
+		for _, v := range a.strings {
+			include = append(include, unicode.Scripts[v])
+		}
+	case runeIdentStartAction:
+		return identStart, identExcluded
+	case runeIdentContinueAction:
+		return identContinue, identExcluded
+	case runeWhitespaceAction:
+		include = []*unicode.RangeTable{unicode.White_Space}
+	}
+	return include, nil
+}
+
 func (g *G) runeExcept(repeatPos *filePosition, a *parseAction, s []string) {
 	p := g.markPosition(runeExceptAction)
 	if a == nil || g.shouldExit(p, runeExceptAction) {
@@ -1448,399 +2266,1039 @@ func (g *G) Corner(name string, precedence int) {
 	a := &parseAction{kind: cornerAction, pos: p, precedence: precedence, name: name}
 	g.nb.append(a)
 }
-func (g *G) Do(stub func()) {
-	p := g.markPosition(doAction)
-	if g.shouldExit(p, doAction) {
-		return
-	} else if stub == nil {
-		g.addError(p, "cant call Sequence() with nil")
-		return
-	}
 
-	args := g.buildArgs(doAction, stub)
-	a := &parseAction{kind: doAction, pos: p, args: args}
-	g.nb.append(a)
-}
+// Operators defines a left recursive rule from a table of operators,
+// where a higher precedence binds tighter, so that
+//
+//	g.Operators("expr", func(op *ez.OpTable) {
+//		op.Left(1, "+", "-")
+//		op.Left(2, "*", "/")
+//		op.Prefix(3, "-")
+//		op.Atom(func() { g.Call("number") })
+//	})
+//
+// expands into Corner(), NoCorner(), Recur() and Stump() calls. each
+// operator gets its own capture, named with an underscore for every
+// operand, i.e "_+_", "-_", "_!", or "_?_:_"
 
-func (g *G) Capture(name string, stub func()) {
-	p := g.markPosition(captureAction)
-	if g.shouldExit(p, captureAction) {
+func (g *G) Operators(name string, stub func(*OpTable)) {
+	p := g.markPosition(operatorsAction)
+
+	if g.grammar == nil {
+		return
+	} else if g.nb == nil {
+		g.addError(p, "must call Operators inside BuildGrammar()")
+		return
+	} else if g.nb.inRule() {
+		g.addError(p, "cant call Operators() inside Define()")
 		return
 	} else if stub == nil {
-		g.addError(p, "cant call Capture() with nil")
+		g.addError(p, "cant call Operators() with nil")
 		return
 	}
 
-	args := g.buildArgs(captureAction, stub)
-
-	a := &parseAction{kind: captureAction, name: name, args: args, pos: p}
-	g.nb.append(a)
-}
-
-func (g *G) Cut() {
-	p := g.markPosition(cutAction)
-	if g.shouldExit(p, cutAction) {
-		return
-	}
-	if !g.nb.nestedInside(choiceAction) {
-		g.addError(p, "cut must be called directly inside choice, sorry.")
+	if oldPos, ok := g.rulePos[name]; ok {
+		g.addErrorf(p, "cant redefine %q, already defined at %v", name, oldPos)
 		return
 	}
 
-	a := &parseAction{kind: cutAction, pos: p}
-	g.nb.append(a)
-}
+	g.rulePos[name] = p
 
-func (g *G) Choice(options ...func()) {
-	p := g.markPosition(choiceAction)
-	if g.shouldExit(p, choiceAction) {
-		return
-	} else if options == nil {
-		g.addError(p, "cant call Choice() with nil")
-		return
-	}
+	a := &parseAction{kind: ruleAction, pos: p, recursiveNames: []string{name}}
+	g.grammar.rules[name] = a
+	g.grammarConfig().names = append(g.grammarConfig().names, name)
 
-	args := make([]*parseAction, len(options))
-	for i, stub := range options {
-		if stub == nil {
-			g.addError(p, "cant call Choice() with nil")
-		} else {
-			stubArgs := g.buildArgs(choiceAction, stub)
-			args[i] = &parseAction{kind: caseAction, pos: p, args: stubArgs}
+	op := &OpTable{g: g, name: name, pos: p}
+	a.args = g.buildRule(name, func() {
+		stub(op)
+		if len(g.nb.args) > 0 {
+			g.addError(p, "cant call actions inside Operators(), use Atom()")
+			return
 		}
-	}
-	a := &parseAction{kind: choiceAction, args: args, pos: p}
-	g.nb.append(a)
+		op.build()
+	})
+	op.done = true
 }
 
-func (g *G) Lookahead(stub func()) {
-	p := g.markPosition(lookaheadAction)
-	if g.shouldExit(p, lookaheadAction) {
-		return
-	} else if stub == nil {
-		g.addError(p, "cant call Lookahead() with nil")
-		return
-	}
-	args := g.buildArgs(lookaheadAction, stub)
-	a := &parseAction{kind: lookaheadAction, args: args, pos: p}
-	g.nb.append(a)
-}
+type opKind int
 
-func (g *G) Reject(stub func()) {
-	p := g.markPosition(rejectAction)
-	if g.shouldExit(p, rejectAction) {
-		return
-	} else if stub == nil {
-		g.addError(p, "cant call Reject() with nil")
-		return
-	}
-	args := g.buildArgs(rejectAction, stub)
-	a := &parseAction{kind: rejectAction, args: args, pos: p}
-	g.nb.append(a)
-}
+const (
+	opLeft opKind = iota
+	opRight
+	opNonAssoc
+	opPrefix
+	opPostfix
+	opTernary
+)
 
-type RepeatOptions struct {
-	g *G
-	a *parseAction
-	p *filePosition
+type opEntry struct {
+	kind       opKind
+	precedence int
+	ops        []string
+	pos        *filePosition
 }
 
-func (ro RepeatOptions) Min(min int) RepeatBlock {
-	return ro.g.repeatMin(ro.p, ro.a, min)
-}
+// OpTable holds the operators passed to g.Operators()
 
-func (ro RepeatOptions) Max(max int) RepeatBlock {
-	return ro.g.repeatMax(ro.p, ro.a, max)
+type OpTable struct {
+	g     *G
+	name  string
+	pos   *filePosition
+	ops   []opEntry
+	atoms [][]*parseAction
+	space func()
+	done  bool
 }
 
-func (ro RepeatOptions) MinMax(min int, max int) RepeatBlock {
-	return ro.g.repeatMinMax(ro.p, ro.a, min, max)
-}
+// Left adds left associative infix operators, a+b+c is (a+b)+c
 
-func (ro RepeatOptions) N(n int) RepeatBlock {
-	return ro.g.repeatN(ro.p, ro.a, n)
+func (op *OpTable) Left(precedence int, ops ...string) {
+	op.add(opLeftAction, opLeft, precedence, ops)
 }
 
-func (ro RepeatOptions) Do(stub func()) {
-	ro.g.repeatSequence(ro.p, ro.a, stub)
-}
+// Right adds right associative infix operators, a=b=c is a=(b=c)
 
-func (ro RepeatOptions) Choice(options ...func()) {
-	ro.g.repeatChoice(ro.p, ro.a, options)
+func (op *OpTable) Right(precedence int, ops ...string) {
+	op.add(opRightAction, opRight, precedence, ops)
 }
 
-type RepeatBlock struct {
-	g *G
-	a *parseAction
-	p *filePosition
+// NonAssoc adds infix operators that cannot be chained, a<b<c fails
+
+func (op *OpTable) NonAssoc(precedence int, ops ...string) {
+	op.add(opNonAssocAction, opNonAssoc, precedence, ops)
 }
 
-func (ro RepeatBlock) Do(stub func()) {
-	ro.g.repeatSequence(ro.p, ro.a, stub)
+// Prefix adds prefix operators, like -a
+
+func (op *OpTable) Prefix(precedence int, ops ...string) {
+	op.add(opPrefixAction, opPrefix, precedence, ops)
 }
 
-func (ro RepeatBlock) Choice(options ...func()) {
-	ro.g.repeatChoice(ro.p, ro.a, options)
+// Postfix adds postfix operators, like a!
+
+func (op *OpTable) Postfix(precedence int, ops ...string) {
+	op.add(opPostfixAction, opPostfix, precedence, ops)
 }
 
-func (g *G) Repeat() RepeatOptions {
-	p := g.markPosition(repeatAction)
-	ro := RepeatOptions{g: g, p: p}
+// Ternary adds a right associative ternary operator, like a?b:c, where
+// the middle operand can be any expression
 
-	if g.shouldExit(p, repeatAction) {
-		return ro
-	}
+func (op *OpTable) Ternary(precedence int, open string, close string) {
+	op.add(opTernaryAction, opTernary, precedence, []string{open, close})
+}
 
-	a := &parseAction{kind: repeatAction, pos: p}
-	g.nb.append(a)
-	ro.a = a
-	return ro
+// Atom adds an operand, which is tried after the operators
 
+func (op *OpTable) Atom(stub func()) {
+	g := op.g
+	p := g.markPosition(opAtomAction)
+	if op.done {
+		g.addError(p, "cant call Atom() outside of Operators()")
+		return
+	} else if stub == nil {
+		g.addError(p, "cant call Atom() with nil")
+		return
+	}
+	op.atoms = append(op.atoms, g.buildArgs(caseAction, stub))
 }
 
-func (g *G) repeatMin(repeatPos *filePosition, a *parseAction, min int) RepeatBlock {
-	p := g.markPosition(repeatAction)
-	rb := RepeatBlock{g: g, a: a, p: p}
-	if a == nil || g.shouldExit(p, a.kind) {
-		return rb
-	}
+// Space is matched around every operator, i.e g.Whitespace()
 
-	if p.n-repeatPos.n != 1 {
-		g.addError(p, "called in wrong position")
-		return rb
+func (op *OpTable) Space(stub func()) {
+	g := op.g
+	p := g.markPosition(opSpaceAction)
+	if op.done {
+		g.addError(p, "cant call Space() outside of Operators()")
+		return
+	} else if stub == nil {
+		g.addError(p, "cant call Space() with nil")
+		return
 	}
-	a.min = min
-	return rb
+	op.space = stub
 }
 
-func (g *G) repeatMax(repeatPos *filePosition, a *parseAction, max int) RepeatBlock {
-	p := g.markPosition(repeatAction)
-	rb := RepeatBlock{g: g, a: a, p: p}
-	if a == nil || g.shouldExit(p, a.kind) {
-		return rb
+func (op *OpTable) add(action string, kind opKind, precedence int, ops []string) {
+	g := op.g
+	p := g.markPosition(action)
+	if op.done {
+		g.addErrorf(p, "cant call %v() outside of Operators()", action)
+		return
+	} else if len(ops) == 0 {
+		g.addError(p, "missing operand")
+		return
+	} else if precedence < 0 {
+		g.addErrorf(p, "precedence %v cannot be negative", precedence)
+		return
+	} else if !g.grammarConfig().actionAllowed(stringAction) {
+		g.addErrorf(p, "cannot call %v() in %v", action, g.grammarConfig().name)
+		return
 	}
-
-	if p.n-repeatPos.n != 1 {
-		g.addError(p, "called in wrong position")
-		return rb
+	for _, v := range ops {
+		if !utf8.ValidString(v) {
+			g.addErrorf(p, "operator %q contains invalid UTF-8", v)
+		} else if v == "" {
+			g.addErrorf(p, "operator %q is empty string", v)
+		}
+		for _, b := range g.grammarConfig().stringsReserved {
+			if strings.Index(v, b) > -1 {
+				g.addErrorf(p, "operator %q contains reserved string %q", v, b)
+			}
+		}
 	}
-	a.max = max
-	return rb
+	op.ops = append(op.ops, opEntry{kind: kind, precedence: precedence, ops: ops, pos: p})
 }
 
-func (g *G) repeatMinMax(repeatPos *filePosition, a *parseAction, min int, max int) RepeatBlock {
-	p := g.markPosition(repeatAction)
-	rb := RepeatBlock{g: g, a: a, p: p}
-	if a == nil || g.shouldExit(p, a.kind) {
-		return rb
+func (op *OpTable) build() {
+	g := op.g
+	name := op.name
+
+	if len(op.atoms) == 0 {
+		g.addError(op.pos, "Operators() needs at least one Atom()")
+		return
 	}
 
-	if p.n-repeatPos.n != 1 {
-		g.addError(p, "called in wrong position")
-		return rb
+	entries := make([]opEntry, len(op.ops))
+	copy(entries, op.ops)
+	sort.SliceStable(entries, func(i, j int) bool {
+		return entries[i].precedence < entries[j].precedence
+	})
+
+	top := 0
+	for _, e := range entries {
+		if e.precedence >= top {
+			top = e.precedence + 1
+		}
 	}
-	a.min = min
-	a.max = max
-	return rb
-}
 
-func (g *G) repeatN(repeatPos *filePosition, a *parseAction, n int) RepeatBlock {
-	p := g.markPosition(repeatAction)
-	rb := RepeatBlock{g: g, a: a, p: p}
-	if a == nil || g.shouldExit(p, a.kind) {
-		return rb
+	args := []*parseAction{}
+	for _, e := range entries {
+		p := e.pos
+		str := func(s string) *parseAction {
+			return &parseAction{kind: stringAction, strings: []string{s}, pos: p}
+		}
+		call := func(kind string) *parseAction {
+			return &parseAction{kind: kind, name: name, pos: p}
+		}
+		space := func() []*parseAction {
+			if op.space == nil {
+				return nil
+			}
+			return []*parseAction{{kind: doAction, args: g.buildArgs(doAction, op.space), pos: p}}
+		}
+		seq := func(parts ...[]*parseAction) []*parseAction {
+			out := []*parseAction{}
+			for _, part := range parts {
+				out = append(out, part...)
+			}
+			return out
+		}
+		one := func(a *parseAction) []*parseAction {
+			return []*parseAction{a}
+		}
+
+		cornerKind := cornerAction
+		var captures []*parseAction
+
+		switch e.kind {
+		case opLeft, opRight, opNonAssoc:
+			left, right := recurAction, stumpAction
+			if e.kind == opRight {
+				left, right = stumpAction, recurAction
+			} else if e.kind == opNonAssoc {
+				left, right = stumpAction, stumpAction
+			}
+			for _, o := range e.ops {
+				body := seq(one(call(left)), space(), one(str(o)), space(), one(call(right)))
+				captures = append(captures, &parseAction{kind: captureAction, name: "_" + o + "_", args: body, pos: p})
+			}
+		case opPrefix:
+			cornerKind = noCornerAction
+			for _, o := range e.ops {
+				body := seq(one(str(o)), space(), one(call(recurAction)))
+				captures = append(captures, &parseAction{kind: captureAction, name: o + "_", args: body, pos: p})
+			}
+		case opPostfix:
+			for _, o := range e.ops {
+				body := seq(one(call(recurAction)), space(), one(str(o)))
+				captures = append(captures, &parseAction{kind: captureAction, name: "_" + o, args: body, pos: p})
+			}
+		case opTernary:
+			open, close := e.ops[0], e.ops[1]
+			body := seq(one(call(stumpAction)), space(), one(str(open)), space(), one(call(callAction)),
+				space(), one(str(close)), space(), one(call(recurAction)))
+			captures = append(captures, &parseAction{kind: captureAction, name: "_" + open + "_" + close + "_", args: body, pos: p})
+		}
+
+		for _, c := range captures {
+			corner := &parseAction{kind: cornerKind, name: name, precedence: e.precedence, pos: p}
+			args = append(args, &parseAction{kind: caseAction, args: []*parseAction{corner, c}, pos: p})
+		}
 	}
 
-	if p.n-repeatPos.n != 1 {
-		g.addError(p, "called in wrong position")
-		return rb
+	for _, atom := range op.atoms {
+		noCorner := &parseAction{kind: noCornerAction, name: name, precedence: top, pos: op.pos}
+		args = append(args, &parseAction{kind: caseAction, args: append([]*parseAction{noCorner}, atom...), pos: op.pos})
 	}
-	a.min = n
-	a.max = n
-	return rb
+
+	g.nb.append(&parseAction{kind: choiceAction, args: args, pos: op.pos})
 }
 
-func (g *G) repeatSequence(repeatPos *filePosition, a *parseAction, stub func()) {
-	p := g.markPosition(repeatAction)
-	if a == nil || g.shouldExit(p, a.kind) {
+func (g *G) Do(stub func()) {
+	p := g.markPosition(doAction)
+	if g.shouldExit(p, doAction) {
 		return
-	}
-
-	if p.n-repeatPos.n != 1 {
-		g.addError(p, "called in wrong position")
+	} else if stub == nil {
+		g.addError(p, "cant call Sequence() with nil")
 		return
 	}
 
-	if stub == nil {
-		g.addError(p, "cant call Do() with nil")
+	args := g.buildArgs(doAction, stub)
+	a := &parseAction{kind: doAction, pos: p, args: args}
+	g.nb.append(a)
+}
+
+// Lexeme matches the stub without skipping trivia inside it
+
+func (g *G) Lexeme(stub func()) {
+	p := g.markPosition(lexemeAction)
+	if g.shouldExit(p, lexemeAction) {
+		return
+	} else if stub == nil {
+		g.addError(p, "cant call Lexeme() with nil")
 		return
 	}
 
-	a.args = g.buildArgs(repeatAction, stub)
+	args := g.buildArgs(lexemeAction, stub)
+	a := &parseAction{kind: lexemeAction, pos: p, args: args}
+	g.nb.append(a)
 }
 
-func (g *G) repeatChoice(repeatPos *filePosition, a *parseAction, options []func()) {
-	p := g.markPosition(repeatAction)
-	if a == nil || g.shouldExit(p, a.kind) {
+func (g *G) Capture(name string, stub func()) {
+	p := g.markPosition(captureAction)
+	if g.shouldExit(p, captureAction) {
+		return
+	} else if stub == nil {
+		g.addError(p, "cant call Capture() with nil")
 		return
 	}
 
-	if p.n-repeatPos.n != 1 {
-		g.addError(p, "called in wrong position")
+	args := g.buildArgs(captureAction, stub)
+
+	a := &parseAction{kind: captureAction, name: name, args: args, pos: p}
+	g.nb.append(a)
+}
+
+func (g *G) Bind(name string, stub func()) {
+	p := g.markPosition(bindAction)
+	if g.shouldExit(p, bindAction) {
+		return
+	} else if stub == nil {
+		g.addError(p, "cant call Bind() with nil")
 		return
 	}
 
-	if len(options) == 0 {
-		g.addError(p, "cant call Choice() with nil")
+	args := g.buildArgs(bindAction, stub)
+
+	a := &parseAction{kind: bindAction, name: name, args: args, pos: p}
+	g.nb.append(a)
+}
+
+func (g *G) Backref(name string) {
+	p := g.markPosition(backrefAction)
+	if g.shouldExit(p, backrefAction) {
 		return
 	}
 
-	args := make([]*parseAction, len(options))
-	for i, stub := range options {
-		if stub == nil {
-			g.addError(p, "cant call Choice() with nil")
-		} else {
-			stubArgs := g.buildArgs(choiceAction, stub)
-			args[i] = &parseAction{kind: caseAction, pos: p, args: stubArgs}
-		}
-	}
-	c := &parseAction{kind: choiceAction, args: args, pos: p}
-	a.args = []*parseAction{c}
+	a := &parseAction{kind: backrefAction, name: name, pos: p}
+	g.nb.append(a)
 }
 
-type OptionalBlock struct {
+type CountOptions struct {
 	g *G
 	a *parseAction
 	p *filePosition
 }
 
-func (ro OptionalBlock) Do(stub func()) {
-	ro.g.optionalSequence(ro.p, ro.a, stub)
+func (co CountOptions) Hex() {
+	co.g.countHex(co.p, co.a)
 }
 
-func (ro OptionalBlock) Choice(options ...func()) {
-	ro.g.optionalChoice(ro.p, ro.a, options)
+func (co CountOptions) BigEndian(width int) {
+	co.g.countEndian(co.p, co.a, countBigEndianAction, width)
 }
 
-func (g *G) Optional() OptionalBlock {
-	p := g.markPosition(optionalAction)
-	ob := OptionalBlock{g: g, p: p}
+func (co CountOptions) LittleEndian(width int) {
+	co.g.countEndian(co.p, co.a, countLittleEndianAction, width)
+}
 
-	if g.shouldExit(p, optionalAction) {
-		return ob
+// Count matches a number, decimal unless told otherwise, and binds it to
+// name for Take() or Repeat().Count() later on in the rule
+
+func (g *G) Count(name string) CountOptions {
+	p := g.markPosition(countAction)
+	co := CountOptions{g: g, p: p}
+
+	if g.shouldExit(p, countAction) {
+		return co
 	}
 
-	a := &parseAction{kind: optionalAction, pos: p}
+	a := &parseAction{kind: countAction, name: name, pos: p}
 	g.nb.append(a)
-	ob.a = a
-	return ob
+	co.a = a
+	return co
 }
 
-func (g *G) optionalSequence(optionalPos *filePosition, a *parseAction, stub func()) {
-	p := g.markPosition(optionalAction)
-	if a == nil || g.shouldExit(p, a.kind) {
+func (g *G) countHex(countPos *filePosition, a *parseAction) {
+	p := g.markPosition(countHexAction)
+	if a == nil || g.shouldExit(p, countHexAction) {
 		return
 	}
 
-	if p.n-optionalPos.n != 1 {
+	if p.n-countPos.n != 1 {
 		g.addError(p, "called in wrong position")
 		return
 	}
 
-	if stub == nil {
-		g.addError(p, "cant call Do() with nil")
-		return
-	}
-
-	a.args = g.buildArgs(optionalAction, stub)
+	*a = parseAction{kind: countHexAction, name: a.name, pos: p}
 }
 
-func (g *G) optionalChoice(optionalPos *filePosition, a *parseAction, options []func()) {
-	p := g.markPosition(optionalAction)
-	if a == nil || g.shouldExit(p, a.kind) {
+func (g *G) countEndian(countPos *filePosition, a *parseAction, kind string, width int) {
+	p := g.markPosition(kind)
+	if a == nil || g.shouldExit(p, kind) {
 		return
 	}
 
-	if p.n-optionalPos.n != 1 {
+	if p.n-countPos.n != 1 {
 		g.addError(p, "called in wrong position")
 		return
 	}
 
-	if len(options) == 0 {
-		g.addError(p, "cant call Choice() with nil")
+	if width != 1 && width != 2 && width != 4 && width != 8 {
+		g.addErrorf(p, "%v(%v) must be 1, 2, 4, or 8 bytes wide", kind, width)
 		return
 	}
 
-	args := make([]*parseAction, len(options))
-	for i, stub := range options {
-		if stub == nil {
-			g.addError(p, "cant call Choice() with nil")
-		} else {
-			stubArgs := g.buildArgs(caseAction, stub)
-			args[i] = &parseAction{kind: caseAction, pos: p, args: stubArgs}
-		}
-	}
-	c := &parseAction{kind: choiceAction, args: args, pos: p}
-	a.args = []*parseAction{c}
+	*a = parseAction{kind: kind, name: a.name, pos: p, min: width, max: width}
 }
 
-func (g *G) Builder(name string, stub any) {
-	p := g.markPosition(builderAction)
-	if g.nb == nil {
-		g.addError(p, "must call Builder() inside grammar")
+// Take matches as many runes (in text mode) or bytes (otherwise)
+// as the number bound by Count(name)
+
+func (g *G) Take(name string) {
+	p := g.markPosition(takeAction)
+	if g.shouldExit(p, takeAction) {
 		return
-	} else if g.nb.inRule() {
-		g.addError(p, "cant call Builder() inside define")
+	}
+
+	a := &parseAction{kind: takeAction, name: name, pos: p}
+	g.nb.append(a)
+}
+
+// Predicate calls fn when parsing, and fails if it returns false. fn can
+// look at the text captured so far, and where the parser is
+
+func (g *G) Predicate(fn func(*MatchContext) bool) {
+	p := g.markPosition(predicateAction)
+	if g.shouldExit(p, predicateAction) {
 		return
-	} else if stub == nil {
-		g.addError(p, "cant call Builder() with nil")
+	} else if fn == nil {
+		g.addError(p, "cant call Predicate() with nil")
 		return
 	}
 
-	if _, ok := g.grammar.builders[name]; ok {
-		oldPos := g.builderPos[name]
-		g.addErrorf(p, "cant redefine %q, already defined at %v", name, oldPos)
-	} else {
-		g.builderPos[name] = p
+	a := &parseAction{kind: predicateAction, predicate: fn, pos: p}
+	g.nb.append(a)
+}
 
-		// pass bytes in byte mode?
+// Match calls fn to match input at offset, and fn returns how many bytes
+// it matched. Zero length matches are treated as failing. When reading
+// from an io.Reader, fn is only given the input that's been buffered,
+// and offset is into that. It goes at least 64k past offset, unless
+// the input ends before then
 
-		switch stub.(type) {
-		case func(string, []any) (any, error):
-			g.grammar.builders[name] = stub
-		default:
-			g.addError(p, "builder has wrong type signature. try func(string, []any) (any, error).")
-		}
+func (g *G) Match(name string, fn func(input string, offset int) (length int, ok bool)) {
+	p := g.markPosition(matchAction)
+	if g.shouldExit(p, matchAction) {
+		return
+	} else if fn == nil {
+		g.addError(p, "cant call Match() with nil")
+		return
+	} else if name == "" {
+		g.addError(p, "Match() needs a name, for error messages")
+		return
 	}
 
+	a := &parseAction{kind: matchAction, name: name, matcher: fn, pos: p}
+	g.nb.append(a)
 }
 
-//
-// Grammar
-//
+// Token matches the next token from the Lexer, if it is one of the
+// kinds given, in TokenMode()
 
-type grammarConfig struct {
-	name            string
-	actionsDisabled []string
-	stringsReserved []string
-	tabstop         int
-	start           string
-	startIdx        int
-	index           map[string]int
-	logFunc         func(string, ...any)
-	names           []string
-}
+func (g *G) Token(kinds ...string) {
+	p := g.markPosition(tokenAction)
+	if g.shouldExit(p, tokenAction) {
+		return
+	} else if len(kinds) == 0 {
+		g.addError(p, "missing operand")
+		return
+	}
 
-func (c *grammarConfig) actionAllowed(s string) bool {
-	for _, v := range c.actionsDisabled {
-		if v == s {
-			return false
+	lexer := g.grammarConfig().lexer
+	if lexer == nil {
+		g.addError(p, "TokenMode() needs a Lexer")
+		return
+	}
+	if lexer.err == nil {
+		for _, k := range kinds {
+			if lexer.kindIndex(k) < 0 {
+				g.addErrorf(p, "Token(%q) isn't defined in the lexer", k)
+			}
 		}
 	}
-	return true
+
+	a := &parseAction{kind: tokenAction, strings: kinds, pos: p}
+	g.nb.append(a)
 }
 
-/// ---
+// Regexp matches a regular expression, anchored at the current offset.
+// In TextMode, the pattern can't contain "\r", "\n", or "\t" literally,
+// but like Rune(), a class like \s or [^'], or ., can still match them
+//
+// When reading from an io.Reader, like Match, the pattern only sees the
+// input that's been buffered, which goes at least 64k past the offset,
+// so a longer match gets cut short
+
+func (g *G) Regexp(pattern string) {
+	p := g.markPosition(regexpAction)
+	if g.shouldExit(p, regexpAction) {
+		return
+	}
+
+	tree, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		g.addErrorf(p, "Regexp(%q) is invalid: %v", pattern, err)
+		return
+	}
+	re := regexp.MustCompile(`^(?:` + pattern + `)`)
+
+	for _, b := range g.grammarConfig().stringsReserved {
+		if regexpHasLiteral(tree, b) {
+			g.addErrorf(p, "Regexp(%q) contains reserved string %q", pattern, b)
+		}
+	}
+
+	// min is the shortest match, for zero width checks
+	min := 1
+	if re.MatchString("") {
+		min = 0
+	}
+
+	a := &parseAction{kind: regexpAction, strings: []string{pattern}, min: min, pos: p, re: re}
+	g.nb.append(a)
+}
+
+// regexpHasLiteral checks literals for the reserved string, like String()
+// does. Character classes and . aren't checked, like Rune()
+
+func regexpHasLiteral(re *syntax.Regexp, s string) bool {
+	if re.Op == syntax.OpLiteral && strings.Contains(string(re.Rune), s) {
+		return true
+	}
+	for _, sub := range re.Sub {
+		if regexpHasLiteral(sub, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (g *G) Cut() {
+	p := g.markPosition(cutAction)
+	if g.shouldExit(p, cutAction) {
+		return
+	}
+	if !g.nb.nestedInside(choiceAction) {
+		g.addError(p, "cut must be called directly inside choice, sorry.")
+		return
+	}
+
+	a := &parseAction{kind: cutAction, pos: p}
+	g.nb.append(a)
+}
+
+func (g *G) Choice(options ...func()) {
+	p := g.markPosition(choiceAction)
+	if g.shouldExit(p, choiceAction) {
+		return
+	} else if options == nil {
+		g.addError(p, "cant call Choice() with nil")
+		return
+	}
+
+	args := make([]*parseAction, len(options))
+	for i, stub := range options {
+		if stub == nil {
+			g.addError(p, "cant call Choice() with nil")
+		} else {
+			stubArgs := g.buildArgs(choiceAction, stub)
+			args[i] = &parseAction{kind: caseAction, pos: p, args: stubArgs}
+		}
+	}
+	a := &parseAction{kind: choiceAction, args: args, pos: p}
+	g.nb.append(a)
+}
+
+func (g *G) Lookahead(stub func()) {
+	p := g.markPosition(lookaheadAction)
+	if g.shouldExit(p, lookaheadAction) {
+		return
+	} else if stub == nil {
+		g.addError(p, "cant call Lookahead() with nil")
+		return
+	}
+	args := g.buildArgs(lookaheadAction, stub)
+	a := &parseAction{kind: lookaheadAction, args: args, pos: p}
+	g.nb.append(a)
+}
+
+func (g *G) Reject(stub func()) {
+	p := g.markPosition(rejectAction)
+	if g.shouldExit(p, rejectAction) {
+		return
+	} else if stub == nil {
+		g.addError(p, "cant call Reject() with nil")
+		return
+	}
+	args := g.buildArgs(rejectAction, stub)
+	a := &parseAction{kind: rejectAction, args: args, pos: p}
+	g.nb.append(a)
+}
+
+type RepeatOptions struct {
+	g *G
+	a *parseAction
+	p *filePosition
+}
+
+func (ro RepeatOptions) Min(min int) RepeatBlock {
+	return ro.g.repeatMin(ro.p, ro.a, min)
+}
+
+func (ro RepeatOptions) Max(max int) RepeatBlock {
+	return ro.g.repeatMax(ro.p, ro.a, max)
+}
+
+func (ro RepeatOptions) MinMax(min int, max int) RepeatBlock {
+	return ro.g.repeatMinMax(ro.p, ro.a, min, max)
+}
+
+func (ro RepeatOptions) N(n int) RepeatBlock {
+	return ro.g.repeatN(ro.p, ro.a, n)
+}
+
+func (ro RepeatOptions) Count(name string) RepeatBlock {
+	return ro.g.repeatCount(ro.p, ro.a, name)
+}
+
+func (ro RepeatOptions) Do(stub func()) {
+	ro.g.repeatSequence(ro.p, ro.a, stub)
+}
+
+func (ro RepeatOptions) Choice(options ...func()) {
+	ro.g.repeatChoice(ro.p, ro.a, options)
+}
+
+type RepeatBlock struct {
+	g *G
+	a *parseAction
+	p *filePosition
+}
+
+func (ro RepeatBlock) Do(stub func()) {
+	ro.g.repeatSequence(ro.p, ro.a, stub)
+}
+
+func (ro RepeatBlock) Choice(options ...func()) {
+	ro.g.repeatChoice(ro.p, ro.a, options)
+}
+
+func (g *G) Repeat() RepeatOptions {
+	p := g.markPosition(repeatAction)
+	ro := RepeatOptions{g: g, p: p}
+
+	if g.shouldExit(p, repeatAction) {
+		return ro
+	}
+
+	a := &parseAction{kind: repeatAction, pos: p}
+	g.nb.append(a)
+	ro.a = a
+	return ro
+
+}
+
+func (g *G) repeatMin(repeatPos *filePosition, a *parseAction, min int) RepeatBlock {
+	p := g.markPosition(repeatAction)
+	rb := RepeatBlock{g: g, a: a, p: p}
+	if a == nil || g.shouldExit(p, a.kind) {
+		return rb
+	}
+
+	if p.n-repeatPos.n != 1 {
+		g.addError(p, "called in wrong position")
+		return rb
+	}
+	a.min = min
+	return rb
+}
+
+func (g *G) repeatMax(repeatPos *filePosition, a *parseAction, max int) RepeatBlock {
+	p := g.markPosition(repeatAction)
+	rb := RepeatBlock{g: g, a: a, p: p}
+	if a == nil || g.shouldExit(p, a.kind) {
+		return rb
+	}
+
+	if p.n-repeatPos.n != 1 {
+		g.addError(p, "called in wrong position")
+		return rb
+	}
+	a.max = max
+	return rb
+}
+
+func (g *G) repeatMinMax(repeatPos *filePosition, a *parseAction, min int, max int) RepeatBlock {
+	p := g.markPosition(repeatAction)
+	rb := RepeatBlock{g: g, a: a, p: p}
+	if a == nil || g.shouldExit(p, a.kind) {
+		return rb
+	}
+
+	if p.n-repeatPos.n != 1 {
+		g.addError(p, "called in wrong position")
+		return rb
+	}
+	a.min = min
+	a.max = max
+	return rb
+}
+
+func (g *G) repeatN(repeatPos *filePosition, a *parseAction, n int) RepeatBlock {
+	p := g.markPosition(repeatAction)
+	rb := RepeatBlock{g: g, a: a, p: p}
+	if a == nil || g.shouldExit(p, a.kind) {
+		return rb
+	}
+
+	if p.n-repeatPos.n != 1 {
+		g.addError(p, "called in wrong position")
+		return rb
+	}
+	a.min = n
+	a.max = n
+	return rb
+}
+
+func (g *G) repeatCount(repeatPos *filePosition, a *parseAction, name string) RepeatBlock {
+	p := g.markPosition(repeatAction)
+	rb := RepeatBlock{g: g, a: a, p: p}
+	if a == nil || g.shouldExit(p, a.kind) {
+		return rb
+	}
+
+	if p.n-repeatPos.n != 1 {
+		g.addError(p, "called in wrong position")
+		return rb
+	}
+	a.name = name
+	return rb
+}
+
+func (g *G) repeatSequence(repeatPos *filePosition, a *parseAction, stub func()) {
+	p := g.markPosition(repeatAction)
+	if a == nil || g.shouldExit(p, a.kind) {
+		return
+	}
+
+	if p.n-repeatPos.n != 1 {
+		g.addError(p, "called in wrong position")
+		return
+	}
+
+	if stub == nil {
+		g.addError(p, "cant call Do() with nil")
+		return
+	}
+
+	a.args = g.buildArgs(repeatAction, stub)
+}
+
+func (g *G) repeatChoice(repeatPos *filePosition, a *parseAction, options []func()) {
+	p := g.markPosition(repeatAction)
+	if a == nil || g.shouldExit(p, a.kind) {
+		return
+	}
+
+	if p.n-repeatPos.n != 1 {
+		g.addError(p, "called in wrong position")
+		return
+	}
+
+	if len(options) == 0 {
+		g.addError(p, "cant call Choice() with nil")
+		return
+	}
+
+	args := make([]*parseAction, len(options))
+	for i, stub := range options {
+		if stub == nil {
+			g.addError(p, "cant call Choice() with nil")
+		} else {
+			stubArgs := g.buildArgs(choiceAction, stub)
+			args[i] = &parseAction{kind: caseAction, pos: p, args: stubArgs}
+		}
+	}
+	c := &parseAction{kind: choiceAction, args: args, pos: p}
+	a.args = []*parseAction{c}
+}
+
+type OptionalBlock struct {
+	g *G
+	a *parseAction
+	p *filePosition
+}
+
+func (ro OptionalBlock) Do(stub func()) {
+	ro.g.optionalSequence(ro.p, ro.a, stub)
+}
+
+func (ro OptionalBlock) Choice(options ...func()) {
+	ro.g.optionalChoice(ro.p, ro.a, options)
+}
+
+func (g *G) Optional() OptionalBlock {
+	p := g.markPosition(optionalAction)
+	ob := OptionalBlock{g: g, p: p}
+
+	if g.shouldExit(p, optionalAction) {
+		return ob
+	}
+
+	a := &parseAction{kind: optionalAction, pos: p}
+	g.nb.append(a)
+	ob.a = a
+	return ob
+}
+
+func (g *G) optionalSequence(optionalPos *filePosition, a *parseAction, stub func()) {
+	p := g.markPosition(optionalAction)
+	if a == nil || g.shouldExit(p, a.kind) {
+		return
+	}
+
+	if p.n-optionalPos.n != 1 {
+		g.addError(p, "called in wrong position")
+		return
+	}
+
+	if stub == nil {
+		g.addError(p, "cant call Do() with nil")
+		return
+	}
+
+	a.args = g.buildArgs(optionalAction, stub)
+}
+
+func (g *G) optionalChoice(optionalPos *filePosition, a *parseAction, options []func()) {
+	p := g.markPosition(optionalAction)
+	if a == nil || g.shouldExit(p, a.kind) {
+		return
+	}
+
+	if p.n-optionalPos.n != 1 {
+		g.addError(p, "called in wrong position")
+		return
+	}
+
+	if len(options) == 0 {
+		g.addError(p, "cant call Choice() with nil")
+		return
+	}
+
+	args := make([]*parseAction, len(options))
+	for i, stub := range options {
+		if stub == nil {
+			g.addError(p, "cant call Choice() with nil")
+		} else {
+			stubArgs := g.buildArgs(caseAction, stub)
+			args[i] = &parseAction{kind: caseAction, pos: p, args: stubArgs}
+		}
+	}
+	c := &parseAction{kind: choiceAction, args: args, pos: p}
+	a.args = []*parseAction{c}
+}
+
+func (g *G) Builder(name string, stub any) {
+	p := g.markPosition(builderAction)
+	if g.nb == nil {
+		g.addError(p, "must call Builder() inside grammar")
+		return
+	} else if g.nb.inRule() {
+		g.addError(p, "cant call Builder() inside define")
+		return
+	} else if stub == nil {
+		g.addError(p, "cant call Builder() with nil")
+		return
+	}
+
+	if _, ok := g.grammar.builders[name]; ok {
+		oldPos := g.builderPos[name]
+		g.addErrorf(p, "cant redefine %q, already defined at %v", name, oldPos)
+	} else {
+		g.builderPos[name] = p
+
+		// pass bytes in byte mode?
+
+		switch stub.(type) {
+		case func(string, []any) (any, error):
+			g.grammar.builders[name] = stub
+		case func(*BuildContext, []any) (any, error):
+			g.grammar.builders[name] = stub
+		default:
+			fn, err := reflectBuilder(stub)
+			if err != nil {
+				g.addErrorf(p, "builder has wrong type signature, %v. try func(string, []any) (any, error).", err)
+				return
+			}
+			g.grammar.builders[name] = fn
+			g.builderTypes[name] = reflect.TypeOf(stub)
+		}
+	}
+
+}
+
+// BuilderOf turns a builder returning a T into one returning any, for
+// passing to ParseTree.Build
+
+func BuilderOf[T any](fn func(string, []any) (T, error)) func(string, []any) (any, error) {
+	return func(s string, args []any) (any, error) {
+		return fn(s, args)
+	}
+}
+
+var errorType = reflect.TypeOf((*error)(nil)).Elem()
+var anySliceType = reflect.TypeOf([]any(nil))
+
+// builderParams returns the types of the arguments a builder takes, and
+// the type of any variadic arguments. ok is false for builders that take
+// every argument as a []any
+
+func builderParams(t reflect.Type) (params []reflect.Type, rest reflect.Type, ok bool) {
+	n := t.NumIn()
+	if n == 2 && !t.IsVariadic() && t.In(1) == anySliceType {
+		return nil, nil, false
+	}
+	if t.IsVariadic() {
+		n--
+		rest = t.In(n).Elem()
+	}
+	for i := 1; i < n; i++ {
+		params = append(params, t.In(i))
+	}
+	return params, rest, true
+}
+
+var buildContextType = reflect.TypeOf((*BuildContext)(nil))
+
+// reflectBuilder wraps functions like func(string, *string, any) (T, error)
+// so that they can be called like any other builder. the first argument
+// can be a *BuildContext instead of a string
+
+func reflectBuilder(stub any) (func(*BuildContext, []any) (any, error), error) {
+	t := reflect.TypeOf(stub)
+	if t == nil || t.Kind() != reflect.Func {
+		return nil, fmt.Errorf("%T is not a function", stub)
+	}
+	if t.NumIn() < 1 || (t.In(0).Kind() != reflect.String && t.In(0) != buildContextType) {
+		return nil, errors.New("first argument must be a string or *BuildContext")
+	}
+	if t.NumOut() != 2 || t.Out(1) != errorType {
+		return nil, errors.New("must return a value and an error")
+	}
+
+	v := reflect.ValueOf(stub)
+	params, rest, ok := builderParams(t)
+
+	return func(ctx *BuildContext, args []any) (any, error) {
+		var in []reflect.Value
+		if t.In(0) == buildContextType {
+			in = append(in, reflect.ValueOf(ctx))
+		} else {
+			in = append(in, reflect.ValueOf(ctx.Text()).Convert(t.In(0)))
+		}
+
+		if !ok {
+			in = append(in, reflect.ValueOf(args))
+		} else if len(args) < len(params) || (rest == nil && len(args) > len(params)) {
+			return nil, fmt.Errorf("builder takes %v arguments, but got %v", len(params), len(args))
+		} else {
+			for i, arg := range args {
+				pt := rest
+				if i < len(params) {
+					pt = params[i]
+				}
+				if arg == nil {
+					in = append(in, reflect.Zero(pt))
+					continue
+				}
+				av := reflect.ValueOf(arg)
+				if !av.Type().AssignableTo(pt) {
+					return nil, fmt.Errorf("builder argument %v is %T, not %v", i+1, arg, pt)
+				}
+				in = append(in, av)
+			}
+		}
+
+		out := v.Call(in)
+		if err, _ := out[1].Interface().(error); err != nil {
+			return nil, err
+		}
+		return out[0].Interface(), nil
+	}, nil
+}
+
+//
+// Grammar
+//
+
+type grammarConfig struct {
+	name            string
+	actionsDisabled []string
+	stringsReserved []string
+	tabstop         int
+	textMode        bool // Take() counts runes, not bytes
+	runeColumns     bool // columns count runes, not bytes
+	start           string
+	startIdx        int
+	index           map[string]int
+	logFunc         func(string, ...any)
+	names           []string
+	trivia          bool // skip the trivia rule before terminals
+	triviaIdx       int
+	lexer           *Lexer // in token mode
+}
+
+func (c *grammarConfig) actionAllowed(s string) bool {
+	for _, v := range c.actionsDisabled {
+		if v == s {
+			return false
+		}
+	}
+	return true
+}
+
+/// ---
 
 type Grammar struct {
 	config   *grammarConfig
@@ -1871,6 +3329,470 @@ func (g *Grammar) Parser() *Parser {
 	return p
 }
 
+// WriteEBNF writes out every rule as ISO 14977 EBNF. Anything EBNF
+// can't express, like lookahead, regular expressions, or indentation,
+// is written as a special sequence, i.e ? not followed by "x" ?, and
+// captures are written as comments. Rule names are turned into meta
+// identifiers, so "value?" becomes "value opt"
+
+func (g *Grammar) WriteEBNF(w io.Writer) error {
+	return g.writeRules(w, &grammarWriter{
+		ebnf:     true,
+		define:   " = ",
+		end:      " ;",
+		seq:      " , ",
+		choice:   " | ",
+		comment:  "(* %v *)",
+		anyRune:  "? any character ?",
+		anyByte:  "? any byte ?",
+		optional: func(seq string, group string) string { return "[ " + seq + " ]" },
+		repeat: func(seq string, group string, min int, max int) string {
+			switch {
+			case min == 0 && max == 0:
+				return "{ " + seq + " }"
+			case max == 0:
+				return repeatFactor(min, group) + " , { " + seq + " }"
+			case min == max:
+				return repeatFactor(min, group)
+			case min == 0:
+				return repeatFactor(max, "[ "+seq+" ]")
+			}
+			return repeatFactor(min, group) + " , " + repeatFactor(max-min, "[ "+seq+" ]")
+		},
+	})
+}
+
+func repeatFactor(n int, group string) string {
+	if n == 1 {
+		return group
+	}
+	return fmt.Sprintf("%v * %v", n, group)
+}
+
+// special is an EBNF special sequence, which can't contain a "?", so
+// any text with one is written as a Go string, with \x3f instead
+
+func special(text string) string {
+	if strings.Contains(text, "?") {
+		text = strings.ReplaceAll(strconv.Quote(text), "?", `\x3f`)
+	}
+	return "? " + text + " ?"
+}
+
+// unspecial takes the text out of a lone special sequence, so that
+// it can go inside another one
+
+func unspecial(s string) string {
+	if inner, ok := strings.CutPrefix(s, "? "); ok {
+		if inner, ok = strings.CutSuffix(inner, " ?"); ok && !strings.Contains(inner, "?") {
+			return inner
+		}
+	}
+	return s
+}
+
+// terminal is an EBNF terminal string, which can't have escapes
+
+func terminal(s string) string {
+	printable := s != ""
+	for _, r := range s {
+		if !unicode.IsPrint(r) {
+			printable = false
+		}
+	}
+	switch {
+	case printable && !strings.Contains(s, `"`):
+		return `"` + s + `"`
+	case printable && !strings.Contains(s, "'"):
+		return "'" + s + "'"
+	}
+	return special(strconv.Quote(s))
+}
+
+// metaIdentifier turns a rule name into letters, digits, and spaces,
+// which EBNF ignores inside a name
+
+func metaIdentifier(name string) string {
+	var out strings.Builder
+	for _, r := range name {
+		switch {
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			out.WriteRune(r)
+		case r == '?':
+			out.WriteString(" opt ")
+		default:
+			out.WriteString(" ")
+		}
+	}
+	id := strings.Join(strings.Fields(out.String()), " ")
+	if r, _ := utf8.DecodeRuneInString(id); !unicode.IsLetter(r) {
+		id = "rule " + id
+	}
+	return id
+}
+
+// WritePEG writes out every rule as a parsing expression grammar, with
+// anything that doesn't fit written as @Action annotations
+
+func (g *Grammar) WritePEG(w io.Writer) error {
+	return g.writeRules(w, &grammarWriter{
+		define:   " <- ",
+		seq:      " ",
+		choice:   " / ",
+		comment:  "# %v",
+		anyRune:  ".",
+		anyByte:  ".",
+		optional: func(seq string, group string) string { return group + "?" },
+		repeat: func(seq string, group string, min int, max int) string {
+			switch {
+			case min == 0 && max == 0:
+				return group + "*"
+			case min == 1 && max == 0:
+				return group + "+"
+			}
+			return group + repeatSuffix(min, max)
+		},
+	})
+}
+
+func repeatSuffix(min int, max int) string {
+	if max == 0 {
+		return fmt.Sprintf("{%v,}", min)
+	} else if min == max {
+		return fmt.Sprintf("{%v}", min)
+	}
+	return fmt.Sprintf("{%v,%v}", min, max)
+}
+
+type grammarWriter struct {
+	ebnf     bool
+	define   string
+	end      string
+	seq      string
+	choice   string
+	comment  string
+	anyRune  string
+	anyByte  string
+	optional func(seq string, group string) string
+	repeat   func(seq string, group string, min int, max int) string
+}
+
+func (g *Grammar) writeRules(w io.Writer, gw *grammarWriter) error {
+	if g.Err != nil {
+		return g.Err
+	}
+	for _, name := range g.config.names {
+		rule := g.rules[name]
+		notes := []string{}
+		if name == g.config.start {
+			notes = append(notes, "Start")
+		}
+		if name == triviaRule && g.config.trivia {
+			notes = append(notes, "Trivia")
+		} else if rule.token {
+			notes = append(notes, "Token")
+		}
+		if len(rule.recursiveNames) > 0 {
+			notes = append(notes, fmt.Sprintf("Recursive(%v)", strings.Join(rule.recursiveNames, ", ")))
+		}
+		if rule.memo {
+			notes = append(notes, "Memo")
+		}
+		if len(notes) > 0 {
+			if _, err := fmt.Fprintf(w, gw.comment+"\n", strings.Join(notes, ", ")); err != nil {
+				return err
+			}
+		}
+
+		body := gw.seqOf(rule.args)
+		if len(rule.args) == 1 && rule.args[0].kind == choiceAction {
+			// no need for brackets around a top level choice
+			body = gw.choiceOf(rule.args[0])
+		}
+		if body == "" {
+			body = gw.empty()
+		}
+		define := strings.TrimRight(gw.define, " ")
+		if body != "" {
+			define = gw.define + body
+		}
+		if _, err := fmt.Fprintf(w, "%v%v%v\n", gw.name(name), define, gw.end); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (gw *grammarWriter) name(name string) string {
+	if gw.ebnf {
+		return metaIdentifier(name)
+	}
+	return name
+}
+
+// empty is what matches nothing, which EBNF leaves blank
+
+func (gw *grammarWriter) empty() string {
+	if gw.ebnf {
+		return ""
+	}
+	return `""`
+}
+
+func (gw *grammarWriter) choiceOf(a *parseAction) string {
+	out := []string{}
+	for _, c := range a.args {
+		body := gw.seqOf(c.args)
+		if body == "" {
+			body = gw.empty()
+		}
+		out = append(out, body)
+	}
+	return strings.Join(out, gw.choice)
+}
+
+func (gw *grammarWriter) terms(args []*parseAction) []string {
+	out := []string{}
+	for i := 0; i < len(args); i++ {
+		a := args[i]
+		if gw.ebnf && a.kind == rejectAction && i+1 < len(args) &&
+			(args[i+1].kind == runeAction || args[i+1].kind == byteAction) {
+			// !x followed by any character is an exception
+			out = append(out, gw.term(args[i+1])+" - "+gw.group(a.args))
+			i++
+		} else if s := gw.term(a); s != "" {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func (gw *grammarWriter) seqOf(args []*parseAction) string {
+	return strings.Join(gw.terms(args), gw.seq)
+}
+
+// group wraps anything that isn't a single term in brackets
+
+func (gw *grammarWriter) group(args []*parseAction) string {
+	out := gw.terms(args)
+	if len(out) == 1 {
+		return out[0]
+	}
+	return "( " + strings.Join(out, gw.seq) + " )"
+}
+
+// annotation is anything without an equivalent, written as
+// @Action in a PEG, and as a special sequence in EBNF
+
+func (gw *grammarWriter) annotation(text string) string {
+	if gw.ebnf {
+		return special(text)
+	}
+	return "@" + text
+}
+
+func (gw *grammarWriter) alternatives(out []string) string {
+	if len(out) == 1 {
+		return out[0]
+	}
+	return "( " + strings.Join(out, gw.choice) + " )"
+}
+
+// branch is one case of a MatchString(), MatchRune() or MatchByte(),
+// where the key is only peeked at, and the body consumes it
+
+func (gw *grammarWriter) branch(key string, fold bool, a *parseAction) string {
+	if gw.ebnf {
+		if fold {
+			key += " ignoring case"
+		}
+		key = special("followed by " + key)
+	} else if fold {
+		key = "&" + key + "i"
+	} else {
+		key = "&" + key
+	}
+	if body := gw.seqOf(a.args); body != "" {
+		return key + gw.seq + body
+	}
+	return key
+}
+
+// quoteAll quotes each string as a terminal, or as one that ignores case
+
+func (gw *grammarWriter) quoteAll(s []string, fold bool) []string {
+	out := make([]string, len(s))
+	for i, v := range s {
+		switch {
+		case gw.ebnf && fold:
+			out[i] = special(strconv.Quote(v) + " ignoring case")
+		case gw.ebnf:
+			out[i] = terminal(v)
+		case fold:
+			out[i] = strconv.Quote(v) + "i"
+		default:
+			out[i] = strconv.Quote(v)
+		}
+	}
+	return out
+}
+
+func (gw *grammarWriter) term(a *parseAction) string {
+	if a == nil {
+		return ""
+	}
+	switch a.kind {
+	case printAction:
+		return ""
+	case traceAction, doAction, sequenceAction, caseAction, ruleAction:
+		return gw.seqOf(a.args)
+	case callAction, recurAction, stumpAction:
+		return gw.name(a.name)
+	case choiceAction:
+		return "( " + gw.choiceOf(a) + " )"
+	case optionalAction:
+		return gw.optional(gw.seqOf(a.args), gw.group(a.args))
+	case repeatAction:
+		if a.name != "" {
+			if gw.ebnf {
+				return special(fmt.Sprintf("Count(%v) repetitions of %v", a.name, gw.group(a.args)))
+			}
+			return fmt.Sprintf("%v{%v}", gw.group(a.args), a.name)
+		}
+		return gw.repeat(gw.seqOf(a.args), gw.group(a.args), a.min, a.max)
+	case lookaheadAction:
+		if gw.ebnf {
+			return special("followed by " + unspecial(gw.group(a.args)))
+		}
+		return "&" + gw.group(a.args)
+	case rejectAction:
+		if gw.ebnf {
+			return special("not followed by " + unspecial(gw.group(a.args)))
+		}
+		return "!" + gw.group(a.args)
+	case captureAction:
+		if gw.ebnf {
+			// captures don't change what gets matched
+			return gw.group(a.args) + " (* capture " + strings.ReplaceAll(a.name, "*)", "* )") + " *)"
+		}
+		return a.name + ":" + gw.group(a.args)
+
+	case stringAction:
+		return gw.alternatives(gw.quoteAll(a.strings, false))
+	case stringFoldAction:
+		return gw.alternatives(gw.quoteAll(a.strings, true))
+	case byteStringAction, byteListAction:
+		s := make([]string, len(a.bytes))
+		for i, b := range a.bytes {
+			s[i] = string(b)
+		}
+		return gw.alternatives(gw.quoteAll(s, false))
+	case runeAction:
+		return gw.anyRune
+	case byteAction:
+		return gw.anyByte
+	case runeRangeAction, byteRangeAction:
+		out := "[" + strings.Join(a.ranges, "") + "]"
+		if gw.ebnf {
+			return special(out)
+		}
+		return out
+	case runeRangeFoldAction:
+		out := "[" + strings.Join(a.ranges, "") + "]"
+		if gw.ebnf {
+			return special(out + " ignoring case")
+		}
+		return out + "i"
+	case runeExceptAction, byteExceptAction:
+		if gw.ebnf {
+			any := gw.anyRune
+			if a.kind == byteExceptAction {
+				any = gw.anyByte
+			}
+			return any + " - " + special("["+strings.Join(a.ranges, "")+"]")
+		}
+		return "[^" + strings.Join(a.ranges, "") + "]"
+	case runeClassAction, runeScriptAction:
+		out := []string{}
+		for _, n := range a.strings {
+			out = append(out, `\p{`+n+`}`)
+		}
+		if gw.ebnf {
+			return special("[" + strings.Join(out, "") + "]")
+		}
+		return "[" + strings.Join(out, "") + "]"
+	case regexpAction:
+		if gw.ebnf {
+			return special("regexp /" + a.strings[0] + "/")
+		}
+		return "/" + a.strings[0] + "/"
+	case tokenAction:
+		if gw.ebnf {
+			out := make([]string, len(a.strings))
+			for i, k := range a.strings {
+				out[i] = special("token " + k)
+			}
+			return gw.alternatives(out)
+		}
+		return gw.alternatives(a.strings)
+	case spaceAction:
+		return gw.alternatives(gw.quoteAll([]string{" "}, false))
+	case tabAction:
+		return gw.alternatives(gw.quoteAll([]string{"\t"}, false))
+
+	case matchStringAction, matchStringFoldAction:
+		keys := make([]string, 0, len(a.stringSwitch))
+		for k := range a.stringSwitch {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		out := []string{}
+		for _, k := range keys {
+			out = append(out, gw.branch(strconv.Quote(k), a.kind == matchStringFoldAction, a.stringSwitch[k]))
+		}
+		return "( " + strings.Join(out, gw.choice) + " )"
+	case matchRuneAction:
+		keys := make([]rune, 0, len(a.runeSwitch))
+		for k := range a.runeSwitch {
+			keys = append(keys, k)
+		}
+		sort.Slice(keys, func(i, j int) bool { return keys[i] < keys[j] })
+		out := []string{}
+		for _, k := range keys {
+			out = append(out, gw.branch(strconv.Quote(string(k)), false, a.runeSwitch[k]))
+		}
+		return "( " + strings.Join(out, gw.choice) + " )"
+	case matchByteAction:
+		keys := make([]int, 0, len(a.byteSwitch))
+		for k := range a.byteSwitch {
+			keys = append(keys, int(k))
+		}
+		sort.Ints(keys)
+		out := []string{}
+		for _, k := range keys {
+			out = append(out, gw.branch(strconv.Quote(string([]byte{byte(k)})), false, a.byteSwitch[byte(k)]))
+		}
+		return "( " + strings.Join(out, gw.choice) + " )"
+
+	case cornerAction, noCornerAction:
+		return gw.annotation(fmt.Sprintf("%v(%v, %v)", a.kind, a.name, a.precedence))
+	case matchAction, bindAction, backrefAction, takeAction,
+		countAction, countHexAction, countBigEndianAction, countLittleEndianAction:
+		if len(a.args) > 0 {
+			return gw.annotation(fmt.Sprintf("%v(%v, %v)", a.kind, a.name, gw.seqOf(a.args)))
+		}
+		return gw.annotation(fmt.Sprintf("%v(%v)", a.kind, a.name))
+	}
+
+	// indentation, lexemes, and other actions without any
+	// equivalent are written as annotations
+
+	if len(a.args) > 0 {
+		return gw.annotation(fmt.Sprintf("%v( %v )", a.kind, gw.seqOf(a.args)))
+	}
+	return gw.annotation(a.kind)
+}
+
 func buildGrammar(pos *filePosition, mode GrammarMode, stub func(*G)) *Grammar {
 	g := &Grammar{}
 	g.builders = make(map[string]any, 0)
@@ -1885,6 +3807,8 @@ func buildGrammar(pos *filePosition, mode GrammarMode, stub func(*G)) *Grammar {
 		Mode:       mode,
 		rulePos:    make(map[string]*filePosition, 0),
 		builderPos: make(map[string]*filePosition, 0),
+
+		builderTypes: make(map[string]reflect.Type, 0),
 	}
 
 	if stub == nil {
@@ -1902,9 +3826,22 @@ func buildGrammar(pos *filePosition, mode GrammarMode, stub func(*G)) *Grammar {
 		}
 	}
 
-	// grammars must have a start rule
+	// grammars must have a start rule, and lexers need tokens
 
-	if bg.Start == "" {
+	if bg.lexer {
+		tokens := 0
+		for name, rule := range g.rules {
+			if rule.token && name != triviaRule {
+				tokens++
+			}
+		}
+		if tokens == 0 {
+			bg.addError(g.pos, "lexer has no Token() rules")
+		}
+		if bg.Start != "" {
+			bg.addError(g.pos, "lexer cant have a starting rule")
+		}
+	} else if bg.Start == "" {
 		bg.addError(g.pos, "starting rule undefined")
 	} else if _, ok := g.rules[bg.Start]; !ok {
 		bg.addErrorf(g.pos, "starting rule %q is missing", bg.Start)
@@ -1939,15 +3876,52 @@ func buildGrammar(pos *filePosition, mode GrammarMode, stub func(*G)) *Grammar {
 		}
 	}
 
+	// ensure each g.Backref() has a g.Bind() in the same rule,
+	// and each g.Take() has a g.Count()
+
+	for _, rule := range g.rules {
+		bound := make(map[string]bool)
+		counted := make(map[string]bool)
+		rule.walk(func(a *parseAction) {
+			switch a.kind {
+			case bindAction:
+				bound[a.name] = true
+			case countAction, countHexAction, countBigEndianAction, countLittleEndianAction:
+				bound[a.name] = true
+				counted[a.name] = true
+			}
+		})
+		rule.walk(func(a *parseAction) {
+			switch a.kind {
+			case backrefAction:
+				if !bound[a.name] {
+					bg.addErrorf(a.pos, "missing Bind(%q) for Backref() in rule", a.name)
+				}
+			case takeAction:
+				if !counted[a.name] {
+					bg.addErrorf(a.pos, "missing Count(%q) for Take() in rule", a.name)
+				}
+			case repeatAction:
+				if a.name != "" && !counted[a.name] {
+					bg.addErrorf(a.pos, "missing Count(%q) for Repeat().Count() in rule", a.name)
+				}
+			}
+		})
+	}
+
 	// ensure each rule gets called at least once
 
 	for name := range g.rules {
-		if name != bg.Start && callPos[name] == nil {
+		if name != bg.Start && callPos[name] == nil && !(g.config != nil && g.config.trivia && name == triviaRule) && !(bg.lexer && g.rules[name].token) {
 			p := bg.rulePos[name]
 			bg.addErrorf(p, "unused rule %q", name)
 		}
 	}
 
+	if g.config != nil && g.config.lexer != nil && g.config.lexer.err != nil {
+		bg.addErrorf(g.pos, "lexer has errors: %v", g.config.lexer.err)
+	}
+
 	// and every builder has a matching g.Capture()
 
 	if len(g.builders) > 0 {
@@ -1967,6 +3941,52 @@ func buildGrammar(pos *filePosition, mode GrammarMode, stub func(*G)) *Grammar {
 		}
 	}
 
+	// check builders with typed arguments can take what each capture has
+
+	for _, rule := range g.rules {
+		rule.walk(func(a *parseAction) {
+			if a.kind != captureAction {
+				return
+			}
+			t, ok := bg.builderTypes[a.name]
+			if !ok {
+				return
+			}
+			params, rest, ok := builderParams(t)
+			if !ok {
+				return
+			}
+
+			shape := captureShape{exact: true}
+			for _, c := range a.args {
+				shape = shape.then(c.captureShape(g.rules, map[string]bool{}))
+			}
+
+			n := len(params)
+			if shape.min > n && rest == nil || shape.max >= 0 && shape.max < n {
+				bg.addErrorf(a.pos, "capture %q has %v children, but builder takes %v arguments", a.name, shape, n)
+				return
+			}
+			if !shape.exact {
+				return
+			}
+
+			for i, child := range shape.names {
+				pt := rest
+				if i < n {
+					pt = params[i]
+				}
+				ct, ok := bg.builderTypes[child]
+				if !ok || ct.Out(0).Kind() == reflect.Interface {
+					continue
+				}
+				if !ct.Out(0).AssignableTo(pt) {
+					bg.addErrorf(a.pos, "capture %q gets a %v from %q as argument %v, but builder takes %v", a.name, ct.Out(0), child, i+1, pt)
+				}
+			}
+		})
+	}
+
 	// mark all terminal rules
 
 	for _, rule := range g.rules {
@@ -2053,7 +4073,7 @@ func buildGrammar(pos *filePosition, mode GrammarMode, stub func(*G)) *Grammar {
 			} else {
 				for _, n := range indirectCalls[rule_corner] {
 					if n == name {
-						mutuals = append(mutuals, name)
+						mutuals = append(mutuals, rule_corner)
 						break
 					}
 				}
@@ -2109,10 +4129,6 @@ func buildGrammar(pos *filePosition, mode GrammarMode, stub func(*G)) *Grammar {
 				p := bg.rulePos[name]
 				bg.addErrorf(p, "%s is left recursive with %v, but not defined to be", name, missing)
 			}
-			if len(rule.recursiveNames) != 1 || rule.recursiveNames[0] != name {
-				p := bg.rulePos[name]
-				bg.addErrorf(p, "%s is mutually left recursive, and this is currently unsupported", name)
-			}
 
 		} else if len(mutuals) == 1 && mutuals[0] == name {
 			p := bg.rulePos[name]
@@ -2124,6 +4140,49 @@ func buildGrammar(pos *filePosition, mode GrammarMode, stub func(*G)) *Grammar {
 		}
 	}
 
+	// memoize rules, but not left recursive ones
+
+	for name, rule := range g.rules {
+		recursive := rule.recursiveNames != nil && len(rule.recursiveNames) > 0
+		if rule.memo && recursive {
+			p := bg.rulePos[name]
+			bg.addErrorf(p, "%s is left recursive, and cannot be memoized", name)
+		} else if bg.Memo && !recursive {
+			rule.memo = true
+		}
+	}
+
+	// a memoized rule only depends on where the enclosing capture
+	// started if it can call a Predicate, which might look at it
+
+	ruleCalls := make(map[string][]string)
+	for name, rule := range g.rules {
+		rule.walk(func(a *parseAction) {
+			switch a.kind {
+			case predicateAction:
+				rule.predicates = true
+			case callAction, recurAction, stumpAction:
+				ruleCalls[name] = append(ruleCalls[name], a.name)
+			}
+		})
+		if g.config.trivia && name != triviaRule {
+			// trivia is skipped inside any rule
+			ruleCalls[name] = append(ruleCalls[name], triviaRule)
+		}
+	}
+
+	for n = 1; n > 0; {
+		n = 0
+		for name, rule := range g.rules {
+			for _, c := range ruleCalls[name] {
+				if called := g.rules[c]; !rule.predicates && called != nil && called.predicates {
+					rule.predicates = true
+					n++
+				}
+			}
+		}
+	}
+
 	err := errorSummary(pos, bg.errors)
 
 	if err != nil {
@@ -2138,6 +4197,7 @@ func buildGrammar(pos *filePosition, mode GrammarMode, stub func(*G)) *Grammar {
 
 	g.config.start = bg.Start
 	g.config.startIdx = index[bg.Start]
+	g.config.triviaIdx = index[triviaRule]
 	g.config.logFunc = bg.LogFunc
 	g.config.index = index
 
@@ -2151,29 +4211,74 @@ func buildGrammar(pos *filePosition, mode GrammarMode, stub func(*G)) *Grammar {
 type parseFunc func(*parserState) bool
 
 type parserCorner struct {
-	name   string
-	offset int
-	state  *parserState
-	nodes  []Node
+	name      string
+	recursive []string // the rules that can be called while growing the seed
+	offset    int
+	state     *parserState
+	nodes     []Node
+
+	numNodes     int // where the nodes started
+	lastSibling  int
+	countSibling int
 
 	precedence int
 }
 
+func (c *parserCorner) within(name string) bool {
+	for _, n := range c.recursive {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
 type parserInput struct {
 	rules   []parseFunc
 	starts  map[int]int // XXX no column check
 	corner  *parserCorner
-	buf     string
-	length  int
+	buf     string // input, starting from base
+	base    int
+	length  int // offset of the end of buf
 	nodes   []Node
 	tabstop int
+	runes   bool // columns count runes, not bytes
+
+	// when reading from an io.Reader, old input is thrown away once
+	// it is before every offset in marks, which includes the start of
+	// every unfinished capture, and of the tree or record being parsed
+	reader     io.Reader
+	readErr    error
+	eof        bool
+	marks      []int
+	choiceMark int
 
 	inside map[int]int
 
+	tokens    []Token // in token mode
+	tokenMode bool
+
+	memo    map[memoKey]*memoEntry
+	indents map[indentLevel]int
+
 	// these dont get set/used as much
 	trace bool
 	// this needs to be preserved even when a rule fails
 	choiceExit bool
+
+	// rules currently being parsed, and the furthest failure seen
+	stack []int
+	quiet int
+	fail  parserFailure
+}
+
+type parserFailure struct {
+	offset    int
+	line      int
+	column    int
+	lineStart int
+	stack     []int
+	expected  []string
 }
 
 type parserState struct {
@@ -2191,36 +4296,175 @@ type parserState struct {
 	countSibling int
 
 	matchIndent parseFunc
+	indentKey   int // the indentLevel for matchIndent, 0 for none
+
+	bindings *binding
+
+	captureStart int // offset of the innermost capture
 
 	precedence int
+
+	lexeme bool // inside a Lexeme() or Token() rule, so trivia isn't skipped
 }
 
-func atEnd(s *parserState) bool {
-	return s.offset >= s.i.length
+// MatchContext is what a Predicate gets to look at
+
+type MatchContext struct {
+	s *parserState
 }
 
-func peekByte(s *parserState) byte {
-	return s.i.buf[s.offset]
+// Text is the input matched so far inside the enclosing Capture, or
+// from where parsing started, when there isn't one. ParseEach starts
+// again with each record
+
+func (m *MatchContext) Text() string {
+	return inputString(m.s, m.s.captureStart, m.s.offset)
 }
 
-func peekString(s *parserState, n int) string {
-	end := s.offset + n
-	if end > s.i.length {
-		end = s.i.length
+func (m *MatchContext) Offset() int {
+	return m.s.offset
+}
+
+// Line and Column start at 1
+
+func (m *MatchContext) Line() int {
+	return m.s.lineNumber + 1
+}
+
+func (m *MatchContext) Column() int {
+	return m.s.column + 1
+}
+
+// Binding returns what Bind(name) matched, or what Count(name) read
+
+func (m *MatchContext) Binding(name string) (string, bool) {
+	return m.s.bindings.lookup(name)
+}
+
+const readSize = 64 * 1024
+
+// fill reads more input when parsing from a reader, and returns false
+// if the input ends before the offset end
+
+func fill(s *parserState, end int) bool {
+	i := s.i
+	if end <= i.length {
+		return true
+	} else if i.reader == nil || i.eof {
+		return false
+	}
+
+	discardInput(s)
+
+	// read at least as much as we have, to avoid copying too often
+	size := readSize
+	if len(i.buf) > size {
+		size = len(i.buf)
+	}
+	chunk := make([]byte, size)
+	n := 0
+
+	for i.length+n < end || n == 0 {
+		c, err := i.reader.Read(chunk[n:])
+		n += c
+		if err != nil {
+			i.eof = true
+			if err != io.EOF {
+				i.readErr = err
+			}
+			break
+		}
+		if n == len(chunk) {
+			break
+		}
+	}
+
+	i.buf = i.buf + string(chunk[:n])
+	i.length += n
+
+	return end <= i.length
+}
+
+func discardInput(s *parserState) {
+	i := s.i
+	bound := s.offset
+
+	// open captures have a mark, and finished ones have a copy
+	// of their text, so only the marks matter
+
+	for _, m := range i.marks {
+		if m < bound {
+			bound = m
+		}
+	}
+
+	// keep one byte before, to tell \r\n from \n
+	bound--
+
+	if bound-i.base < len(i.buf)/2 {
+		return
+	}
+
+	i.buf = strings.Clone(i.buf[bound-i.base:])
+	i.base = bound
+}
+
+func pushMark(s *parserState) int {
+	n := len(s.i.marks)
+	if s.i.reader != nil {
+		s.i.marks = append(s.i.marks, s.offset)
+	}
+	return n
+}
+
+func setMark(s *parserState, n int) {
+	if s.i.reader != nil {
+		s.i.marks[n] = s.offset
+	}
+}
+
+func popMark(s *parserState, n int) {
+	if s.i.reader != nil {
+		s.i.marks = s.i.marks[:n]
+	}
+}
+
+func inputString(s *parserState, start int, end int) string {
+	return s.i.buf[start-s.i.base : end-s.i.base]
+}
+
+// bindString copies the input when reading, so that a binding doesn't
+// keep old input around
+
+func bindString(s *parserState, start int, end int) string {
+	if s.i.reader != nil {
+		return strings.Clone(inputString(s, start, end))
+	}
+	return inputString(s, start, end)
+}
+
+func atEnd(s *parserState) bool {
+	if s.i.tokenMode {
+		return nextToken(s) >= len(s.i.tokens)
 	}
-	return s.i.buf[s.offset:end]
+	return s.offset >= s.i.length && !fill(s, s.offset+1)
+}
+
+func peekByte(s *parserState) byte {
+	return s.i.buf[s.offset-s.i.base]
 }
 
-func peekBytes(s *parserState, n int) []byte {
+func peekString(s *parserState, n int) string {
 	end := s.offset + n
-	if end > s.i.length {
+	if !fill(s, end) {
 		end = s.i.length
 	}
-	return []byte(s.i.buf[s.offset:end])
+	return inputString(s, s.offset, end)
 }
 
 func peekRune(s *parserState) (rune, int) {
-	return utf8.DecodeRuneInString(s.i.buf[s.offset:])
+	fill(s, s.offset+utf8.UTFMax)
+	return utf8.DecodeRuneInString(s.i.buf[s.offset-s.i.base:])
 }
 
 func advanceState(s *parserState, length int) {
@@ -2229,8 +4473,11 @@ func advanceState(s *parserState, length int) {
 	// in theory this should check whitespace and newlines, but
 	// in practice: no
 
+	buf := s.i.buf
+	base := s.i.base
+
 	for i := s.offset; i < newOffset; i++ {
-		switch s.i.buf[i] {
+		switch buf[i-base] {
 		case byte('\t'):
 			width := 1
 			if s.i.tabstop > 1 {
@@ -2246,11 +4493,14 @@ func advanceState(s *parserState, length int) {
 			s.column = 0
 			s.lineIndent = 0
 			s.lineStart = i + 1
-			if i == 0 || (s.i.buf[i-1] != byte('\r')) {
+			if i == 0 || i == base || (buf[i-1-base] != byte('\r')) {
 				s.lineNumber++
 			}
 		default:
-			s.column += 1
+			// in text and string mode, columns count runes, not bytes
+			if !s.i.runes || utf8.RuneStart(buf[i-base]) {
+				s.column += 1
+			}
 		}
 	}
 
@@ -2267,6 +4517,41 @@ func acceptString(s *parserState, v string) bool {
 	return false
 }
 
+// foldRune picks the smallest rune that r case folds to, so that runes
+// which are equal ignoring case fold to the same rune
+
+func foldRune(r rune) rune {
+	min := r
+	for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+		if f < min {
+			min = f
+		}
+	}
+	return min
+}
+
+func foldString(v string) string {
+	return strings.Map(foldRune, v)
+}
+
+func acceptStringFold(s *parserState, v []rune) bool {
+	// folded runes can be a different length
+	b := peekString(s, len(v)*utf8.UTFMax)
+	i := 0
+	for _, r := range v {
+		if i >= len(b) {
+			return false
+		}
+		c, n := utf8.DecodeRuneInString(b[i:])
+		if c != r && foldRune(c) != r {
+			return false
+		}
+		i += n
+	}
+	advanceState(s, i)
+	return true
+}
+
 func acceptBytes(s *parserState, v []byte) bool {
 	length_v := len(v)
 	b := peekString(s, length_v)
@@ -2291,8 +4576,8 @@ func acceptWhitespace(s *parserState, minWidth int, maxWidth int) bool {
 	w := 0
 	c := 0
 outer:
-	for i := s.offset; i < s.i.length; i++ {
-		b := s.i.buf[i]
+	for i := s.offset; i < s.i.length || fill(s, i+1); i++ {
+		b := s.i.buf[i-s.i.base]
 
 		if b == byte('\t') {
 			tabWidth := s.i.tabstop - (column % s.i.tabstop)
@@ -2334,8 +4619,8 @@ outer:
 func acceptWhitespaceOrNewline(s *parserState) bool {
 	c := 0
 outer:
-	for i := s.offset; i < s.i.length; i++ {
-		switch s.i.buf[i] {
+	for i := s.offset; i < s.i.length || fill(s, i+1); i++ {
+		switch s.i.buf[i-s.i.base] {
 		case byte('\t'), byte(' '), byte('\r'), byte('\n'):
 			c += 1
 		default:
@@ -2356,7 +4641,7 @@ func acceptNewline(s *parserState) bool {
 		return true
 	} else if b == byte('\r') {
 		advanceState(s, 1)
-		if s.offset >= s.i.length {
+		if atEnd(s) {
 			return true
 		}
 		b = peekByte(s)
@@ -2368,6 +4653,52 @@ func acceptNewline(s *parserState) bool {
 	return false
 }
 
+// expectState records a failed terminal, keeping only the ones
+// that failed furthest into the input
+
+func expectState(s *parserState, expected []string) {
+	f := &s.i.fail
+	if s.i.quiet > 0 || s.offset < f.offset {
+		return
+	}
+
+	if s.offset > f.offset || f.stack == nil {
+		f.offset = s.offset
+		f.line = s.lineNumber
+		f.column = s.column
+		f.lineStart = s.lineStart
+		f.stack = append(make([]int, 0, len(s.i.stack)), s.i.stack...)
+		f.expected = f.expected[:0]
+	}
+	addExpected(f, expected)
+}
+
+func addExpected(f *parserFailure, expected []string) {
+outer:
+	for _, e := range expected {
+		for _, v := range f.expected {
+			if v == e {
+				continue outer
+			}
+		}
+		f.expected = append(f.expected, e)
+	}
+}
+
+const maxInt = int(^uint(0) >> 1)
+
+func hexDigit(b byte) int {
+	switch {
+	case b >= '0' && b <= '9':
+		return int(b - '0')
+	case b >= 'a' && b <= 'f':
+		return int(b-'a') + 10
+	case b >= 'A' && b <= 'F':
+		return int(b-'A') + 10
+	}
+	return -1
+}
+
 func copyState(s *parserState, into *parserState) {
 	*into = *s
 }
@@ -2384,6 +4715,7 @@ func startCapture(s *parserState, st *parserState) {
 	*st = *s
 	st.countSibling = 0
 	st.lastSibling = 0
+	st.captureStart = s.offset
 }
 
 func mergeCapture(s *parserState, name string, new *parserState) {
@@ -2404,9 +4736,11 @@ func mergeCapture(s *parserState, name string, new *parserState) {
 	new.lastSibling = lastSibling
 
 	node := Node{
-		name:  name,
-		start: s.offset,
-		end:   new.offset,
+		name:   name,
+		start:  s.offset,
+		end:    new.offset,
+		line:   s.lineNumber,
+		column: s.column,
 		//	children: new.children,
 		sibling:  s.lastSibling,
 		nsibling: s.countSibling,
@@ -2419,11 +4753,12 @@ func mergeCapture(s *parserState, name string, new *parserState) {
 	new.lastSibling = new.numNodes
 	new.countSibling = s.countSibling + 1
 	new.numNodes = new.numNodes + 1
+	new.captureStart = s.captureStart
 	*s = *new
 
 }
 
-func (s *parserState) finalNode(name string) int {
+func (s *parserState) finalNode(name string, start *parserState) int {
 	if s.countSibling == 1 {
 		return s.lastSibling
 	} else {
@@ -2443,9 +4778,11 @@ func (s *parserState) finalNode(name string) int {
 		s.lastSibling = lastSibling
 
 		node := Node{
-			name:  name,
-			start: 0,
-			end:   s.offset,
+			name:   name,
+			start:  start.offset,
+			end:    s.offset,
+			line:   start.lineNumber,
+			column: start.column,
 			//	children: s.children,
 			child:  s.lastSibling,
 			nchild: s.countSibling,
@@ -2464,20 +4801,25 @@ func startCorner(s *parserState, s1 *parserState) {
 	s1.countSibling = 0
 	s1.lastSibling = 0
 	s1.precedence = 0
+	s1.bindings = nil
 }
 
-func pluckCorner(name string, s *parserState, s1 *parserState) {
+func pluckCorner(name string, recursive []string, s *parserState, s1 *parserState) {
 	nodes := []Node{}
 	for i := s.numNodes; i < s1.numNodes; i++ {
 		nodes = append(nodes, s.i.nodes[i])
 	}
 
 	c := &parserCorner{
-		name:       name,
-		state:      s1,
-		offset:     s.offset,
-		nodes:      nodes,
-		precedence: s1.precedence,
+		name:         name,
+		recursive:    recursive,
+		state:        s1,
+		offset:       s.offset,
+		nodes:        nodes,
+		numNodes:     s.numNodes,
+		lastSibling:  s1.lastSibling,
+		countSibling: s1.countSibling,
+		precedence:   s1.precedence,
 	}
 
 	s.i.corner = c
@@ -2490,22 +4832,247 @@ func applyCorner(s *parserState) {
 	s.offset = s1.offset
 	s.column = s1.column
 
-	s.lineStart = s.lineStart
-	s.lineNumber = s.lineNumber
-	s.lineIndent = s.lineIndent
+	s.lineStart = s1.lineStart
+	s.lineNumber = s1.lineNumber
+	s.lineIndent = s1.lineIndent
 
-	for _, n := range c.nodes {
-		n.sibling = s.lastSibling
-		n.nsibling = s.countSibling
+	// the seed keeps its nested captures, and only the top level nodes
+	// are linked in as siblings
 
-		s.i.nodes = append(s.i.nodes[:s.numNodes], n)
+	base := s.numNodes
+	delta := base - c.numNodes
 
-		s.lastSibling = s.numNodes
-		s.countSibling = s.countSibling + 1
-		s.numNodes = s.numNodes + 1
+	s.i.nodes = append(s.i.nodes[:base], c.nodes...)
+	for i := range c.nodes {
+		s.i.nodes[base+i].child += delta
+		s.i.nodes[base+i].sibling += delta
+	}
+
+	next := c.lastSibling + delta
+	for i := c.countSibling - 1; i >= 0; i-- {
+		n := &s.i.nodes[next]
+		n.nsibling = s.countSibling + i
+		next = n.sibling
+		if i == 0 {
+			n.sibling = s.lastSibling
+		}
+	}
+
+	if c.countSibling > 0 {
+		s.lastSibling = c.lastSibling + delta
+		s.countSibling = s.countSibling + c.countSibling
+	}
+	s.numNodes = base + len(c.nodes)
+
+	s.i.corner = nil
+}
+
+// bindings are scoped to the rule that made them, and as they're kept
+// in the parserState, they get thrown away when a rule backtracks
+
+type binding struct {
+	name    string
+	value   string
+	count   int
+	counted bool
+	next    *binding
+}
+
+func (b *binding) lookup(name string) (string, bool) {
+	for b != nil {
+		if b.name == name {
+			return b.value, true
+		}
+		b = b.next
+	}
+	return "", false
+}
+
+func (b *binding) lookupCount(name string) (int, bool) {
+	for b != nil {
+		if b.name == name {
+			return b.count, b.counted
+		}
+		b = b.next
+	}
+	return 0, false
+}
+
+// indentLevel describes one level of indentation on top of another,
+// so that blocks with the same indentation share a key
+
+type indentLevel struct {
+	parent int
+	kind   string
+	width  int
+	prefix string
+}
+
+func indentKey(s *parserState, level indentLevel) int {
+	if k, ok := s.i.indents[level]; ok {
+		return k
+	}
+	if s.i.indents == nil {
+		s.i.indents = make(map[indentLevel]int)
+	}
+	k := len(s.i.indents) + 1
+	s.i.indents[level] = k
+	return k
+}
+
+// memoization caches what a rule does at a given offset, inside a given
+// indentation context, and replays it if called there again
+
+type memoKey struct {
+	rule       int
+	offset     int
+	column     int
+	lineIndent int
+	indentKey  int
+
+	captureStart int // only for rules that call a Predicate
+	lexeme       bool
+}
+
+type memoEntry struct {
+	ok    bool
+	state parserState    // after the rule has matched
+	fail  *parserFailure // what the rule expected, with a stack relative to it
+
+	base  int // s.numNodes, s.lastSibling, s.countSibling, before
+	last  int
+	count int
+	nodes []Node
+}
+
+func memoRule(idx int, predicates bool, rule parseFunc) parseFunc {
+	return func(s *parserState) bool {
+		// left recursion depends on more than just the offset,
+		// and tracing should show every call
+		if s.i.trace || s.i.corner != nil || len(s.i.inside) > 0 {
+			return rule(s)
+		}
+
+		key := memoKey{
+			rule:       idx,
+			offset:     s.offset,
+			column:     s.column,
+			lineIndent: s.lineIndent,
+			indentKey:  s.indentKey,
+			lexeme:     s.lexeme,
+		}
+		if predicates {
+			key.captureStart = s.captureStart
+		}
+
+		if m, ok := s.i.memo[key]; ok {
+			if m.ok {
+				applyMemo(s, m)
+			}
+			replayFailure(s, m.fail)
+			return m.ok
+		}
+
+		if s.i.memo == nil {
+			s.i.memo = make(map[memoKey]*memoEntry)
+		}
+
+		m := &memoEntry{}
+		var s1 parserState
+		copyState(s, &s1)
+
+		// the rule always records what it expected, even when called
+		// quietly, so that a later call can report it in full
+
+		oldFail, oldQuiet := s.i.fail, s.i.quiet
+		s.i.fail, s.i.quiet = parserFailure{}, 0
+		ok := rule(&s1)
+		if f := s.i.fail; f.stack != nil {
+			f.stack = f.stack[len(s.i.stack):]
+			m.fail = &f
+		}
+		s.i.fail, s.i.quiet = oldFail, oldQuiet
+
+		if ok {
+			m.ok = true
+			m.state = s1
+			m.base = s.numNodes
+			m.last = s.lastSibling
+			m.count = s.countSibling
+			m.nodes = append([]Node(nil), s1.i.nodes[s.numNodes:s1.numNodes]...)
+			mergeState(s, &s1)
+		}
+
+		s.i.memo[key] = m
+		replayFailure(s, m.fail)
+		return m.ok
+	}
+}
+
+// replayFailure adds what a memoized rule expected to the parse error,
+// as if the rule had just been called
+
+func replayFailure(s *parserState, m *parserFailure) {
+	f := &s.i.fail
+	if m == nil || s.i.quiet > 0 || m.offset < f.offset {
+		return
+	}
+
+	if m.offset > f.offset || f.stack == nil {
+		f.offset = m.offset
+		f.line = m.line
+		f.column = m.column
+		f.lineStart = m.lineStart
+		f.stack = append(append(make([]int, 0, len(s.i.stack)+len(m.stack)), s.i.stack...), m.stack...)
+		f.expected = f.expected[:0]
+	}
+	addExpected(f, m.expected)
+}
+
+func applyMemo(s *parserState, m *memoEntry) {
+	// the nodes may end up somewhere else in the arena, with
+	// different siblings, so we relocate them
+
+	delta := s.numNodes - m.base
+	nodes := s.i.nodes[:s.numNodes]
+
+	for _, n := range m.nodes {
+		if n.nchild > 0 {
+			n.child += delta
+		}
+		if n.sibling >= m.base {
+			n.sibling += delta
+		}
+		nodes = append(nodes, n)
+	}
+
+	top := m.state.countSibling - m.count
+	lastSibling := s.lastSibling
+
+	if top > 0 {
+		lastSibling = m.state.lastSibling + delta
+		c := lastSibling
+		for i := top - 1; i >= 0; i-- {
+			nodes[c].nsibling = s.countSibling + i
+			if i == 0 {
+				nodes[c].sibling = s.lastSibling
+			}
+			c = nodes[c].sibling
+		}
 	}
 
-	s.i.corner = nil
+	numNodes := s.numNodes + len(m.nodes)
+	countSibling := s.countSibling + top
+	bindings := s.bindings
+	captureStart := s.captureStart
+
+	*s = m.state
+	s.bindings = bindings
+	s.captureStart = captureStart
+	s.i.nodes = nodes
+	s.numNodes = numNodes
+	s.lastSibling = lastSibling
+	s.countSibling = countSibling
 }
 
 func buildRule(c *grammarConfig, name string, a *parseAction) parseFunc {
@@ -2516,6 +5083,24 @@ func buildRule(c *grammarConfig, name string, a *parseAction) parseFunc {
 		}
 	}
 
+	if a.token && c.trivia {
+		b := *a
+		b.token = false
+		rule := buildRule(c, name, &b)
+		idx := c.triviaIdx
+
+		return func(s *parserState) bool {
+			if !s.lexeme {
+				skipTrivia(s, idx)
+			}
+			oldLexeme := s.lexeme
+			s.lexeme = true
+			out := rule(s)
+			s.lexeme = oldLexeme
+			return out
+		}
+	}
+
 	switch a.kind {
 	case ruleAction:
 		rules := make([]parseFunc, len(a.args))
@@ -2530,7 +5115,7 @@ func buildRule(c *grammarConfig, name string, a *parseAction) parseFunc {
 		idx := c.index[name]
 
 		if a.recursiveNames == nil || len(a.recursiveNames) == 0 {
-			return func(s *parserState) bool {
+			rule := func(s *parserState) bool {
 				// exit if corner?
 
 				var s1 parserState
@@ -2539,23 +5124,41 @@ func buildRule(c *grammarConfig, name string, a *parseAction) parseFunc {
 				oldStart := s1.i.starts[idx]
 				s1.i.choiceExit = false
 				s1.i.starts[idx] = s1.offset
+				s1.i.stack = append(s1.i.stack, idx)
+				s1.bindings = nil
 
 				for _, r := range rules {
 					if !r(&s1) {
 						s.i.choiceExit = oldChoice
 						s1.i.starts[idx] = oldStart
+						s1.i.stack = s1.i.stack[:len(s1.i.stack)-1]
 						return false
 					}
 				}
 				s1.i.choiceExit = oldChoice
 				s1.i.starts[idx] = oldStart
+				s1.i.stack = s1.i.stack[:len(s1.i.stack)-1]
+				s1.bindings = s.bindings
 				mergeState(s, &s1)
 				return true
 			}
+
+			if a.memo {
+				return memoRule(idx, a.predicates, rule)
+			}
+			return rule
 		} else {
+			recursive := a.recursiveNames
 			return func(s *parserState) bool {
 				oldChoice := s.i.choiceExit
-				oldStart := s.i.starts[idx]
+				oldStart, started := s.i.starts[idx]
+				restoreStart := func() {
+					if started {
+						s.i.starts[idx] = oldStart
+					} else {
+						delete(s.i.starts, idx)
+					}
+				}
 
 				// if there's already a corner, and it is us
 				// we can grow it (or in our recursiveNames
@@ -2566,37 +5169,48 @@ func buildRule(c *grammarConfig, name string, a *parseAction) parseFunc {
 				startCorner(s, &s1)
 				s.i.choiceExit = false
 				s.i.starts[idx] = s.offset
+				s.i.stack = append(s.i.stack, idx)
+				m := pushMark(s) // the seed gets parsed again as it grows
 
 				for _, r := range rules {
 					if !r(&s1) {
 						s.i.choiceExit = oldChoice
-						s.i.starts[idx] = oldStart
+						restoreStart()
+						s.i.stack = s.i.stack[:len(s.i.stack)-1]
+						popMark(s, m)
 						return false
 					}
 				}
 
-				pluckCorner(name, s, &s1)
+				pluckCorner(name, recursive, s, &s1)
 				//fmt.Println("found seed", s.i.corner.precedence)
 			growCorner:
 				for true {
+					c := s.i.corner
 					var s1 parserState
 					startCorner(s, &s1)
 					for _, r := range rules {
 						if !r(&s1) {
+							s.i.corner = c
 							break growCorner
 						}
 					}
-					if s.i.corner != nil { // shouldn't happen if NoRecur used in rules
+					// a mutually recursive rule can grow (and use up) its own seed
+					// inside ours, so we stop when the seed doesn't get any longer
+					if s.i.corner != nil || s1.offset <= c.state.offset {
+						s.i.corner = c
 						break growCorner
 					}
-					pluckCorner(name, s, &s1)
+					pluckCorner(name, recursive, s, &s1)
 					// fmt.Println("grown seed", s.i.corner.precedence)
 				}
 				// fmt.Println("done", s.i.corner.precedence)
 				applyCorner(s)
 
 				s.i.choiceExit = oldChoice
-				s.i.starts[idx] = oldStart
+				restoreStart()
+				s.i.stack = s.i.stack[:len(s.i.stack)-1]
+				popMark(s, m)
 
 				return true
 			}
@@ -2616,6 +5230,81 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 			return true
 		}
 	}
+	if c.trivia && skipsTrivia(a.kind) {
+		rule := buildActionFunc(c, a)
+		idx := c.triviaIdx
+
+		return func(s *parserState) bool {
+			if !s.lexeme {
+				skipTrivia(s, idx)
+			}
+			return rule(s)
+		}
+	}
+	if c.lexer != nil && a.kind == captureAction {
+		// captures start at the next token, not before the trivia
+		rule := buildActionFunc(c, a)
+		return func(s *parserState) bool {
+			if i := nextToken(s); i < len(s.i.tokens) {
+				s.i.tokens[i].from.moveState(s)
+			}
+			return rule(s)
+		}
+	}
+	return buildActionFunc(c, a)
+}
+
+// skipsTrivia is true for terminals that skip trivia first. Space, Tab,
+// Newline, Rune().Whitespace(), and the other whitespace matching
+// terminals are left out, as skipping trivia beforehand would usually
+// leave them nothing to match
+
+func skipsTrivia(kind string) bool {
+	switch kind {
+	case stringAction, stringFoldAction,
+		runeAction, runeRangeAction, runeExceptAction, runeRangeFoldAction,
+		runeClassAction, runeScriptAction, runeIdentStartAction, runeIdentContinueAction,
+		matchRuneAction, matchStringAction, matchStringFoldAction,
+		matchAction, regexpAction, backrefAction,
+		endOfFileAction,
+		captureAction, lexemeAction:
+		return true
+	}
+	return false
+}
+
+// skipTrivia matches the trivia rule until it fails, without
+// adding anything to the expected set of a parse error
+
+func skipTrivia(s *parserState, idx int) {
+	rule := s.i.rules[idx]
+	s.lexeme = true
+	s.i.quiet++
+	m := pushMark(s)
+	for {
+		var s1 parserState
+		copyState(s, &s1)
+		if !rule(&s1) || s1.offset == s.offset {
+			break
+		}
+		mergeState(s, &s1)
+		setMark(s, m)
+	}
+	popMark(s, m)
+	s.i.quiet--
+	s.lexeme = false
+}
+
+// skipTrailing skips any trivia after the last terminal, so that
+// trailing whitespace or comments aren't left over as input
+
+func (p *Parser) skipTrailing(s *parserState) {
+	if p.config.trivia && !s.lexeme {
+		skipTrivia(s, p.config.triviaIdx)
+	}
+}
+
+func buildActionFunc(c *grammarConfig, a *parseAction) parseFunc {
 	switch a.kind {
 	case printAction:
 		prefix := a.pos
@@ -2623,8 +5312,8 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 		return func(s *parserState) bool {
 			msg := fmt.Sprint(a.message...)
 			fn("%v: Print(%q) called, at line %v, col %v\n", prefix, msg, s.lineNumber, s.column)
-			if s.offset < s.i.length {
-				fn("next char: %q\n", s.i.buf[s.offset])
+			if !atEnd(s) {
+				fn("next char: %q\n", peekByte(s))
 			}
 			return true
 		}
@@ -2753,8 +5442,9 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 				}
 				return false
 
-			} else if s.i.corner == nil {
-				// we are not the left most rule
+			} else if s.i.corner == nil || (s.i.corner.offset == s.offset && s.i.corner.within(name)) {
+				// we are not the left most rule, or we are a mutually
+				// recursive rule, called while another grows its seed
 				if s.i.trace {
 					fn("%v: Call Recur(%q) starting, at line %v, col %v\n", prefix, name, s.lineNumber, s.column)
 				}
@@ -2807,7 +5497,19 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 				rule = s.i.rules[idx] // can't move this out to runtime unless we reorder defs
 			}
 
+			// a call starts a new expression, so any precedence
+			// from an enclosing Recur() doesn't apply, or "(1+2)"
+			// would fail inside a "*" in the same rule
+			oldInside, inside := s.i.inside[idx]
+			if inside {
+				delete(s.i.inside, idx)
+			}
+
 			out := rule(s)
+
+			if inside {
+				s.i.inside[idx] = oldInside
+			}
 			if s.i.trace {
 				if out {
 					fn("%v: Call(%q) exiting, at line %v, col %v\n", prefix, name, s.lineNumber, s.column)
@@ -2843,6 +5545,7 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 			}
 
 			s1.matchIndent = newMatch
+			s1.indentKey = indentKey(s, indentLevel{parent: s.indentKey, kind: offsideBlockAction, width: width})
 
 			for _, r := range rules {
 				if !r(&s1) {
@@ -2851,6 +5554,7 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 			}
 
 			s1.matchIndent = oldMatch
+			s1.indentKey = s.indentKey
 			mergeState(s, &s1)
 			return true
 		}
@@ -2865,6 +5569,7 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 			copyState(s, &s1)
 
 			oldMatch := s.matchIndent
+			oldKey := s.indentKey
 
 			newMatch := func(s *parserState) bool {
 				if oldMatch != nil && !oldMatch(s) {
@@ -2877,16 +5582,18 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 					return false
 				}
 
-				prefix := s.i.buf[start:s.offset]
+				prefix := inputString(s, start, s.offset)
 
 				s.matchIndent = func(s *parserState) bool {
 					return (oldMatch == nil || oldMatch(s)) && acceptString(s, prefix)
 				}
+				s.indentKey = indentKey(s, indentLevel{parent: oldKey, kind: indentAction, prefix: prefix})
 
 				return true
 			}
 
 			s1.matchIndent = newMatch
+			s1.indentKey = indentKey(s, indentLevel{parent: oldKey, kind: indentedBlockAction})
 
 			for _, r := range rules {
 				if !r(&s1) {
@@ -2894,11 +5601,13 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 				}
 			}
 			s1.matchIndent = s.matchIndent
+			s1.indentKey = s.indentKey
 			mergeState(s, &s1)
 			return true
 		}
 
 	case indentAction:
+		expected := a.expected()
 		return func(s *parserState) bool {
 			if s.matchIndent == nil {
 				s.lineIndent = s.column
@@ -2907,24 +5616,29 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 				s.lineIndent = s.column
 				return true
 			}
+			expectState(s, expected)
 			return false
 		}
 
 	// case dedentAction
 
 	case spaceAction:
+		expected := a.expected()
 		return func(s *parserState) bool {
-			if atEnd(s) {
-				return false
+			if !atEnd(s) && acceptString(s, " ") {
+				return true
 			}
-			return acceptString(s, " ")
+			expectState(s, expected)
+			return false
 		}
 	case tabAction:
+		expected := a.expected()
 		return func(s *parserState) bool {
-			if atEnd(s) {
-				return false
+			if !atEnd(s) && acceptString(s, "\t") {
+				return true
 			}
-			return acceptString(s, "\t")
+			expectState(s, expected)
+			return false
 		}
 
 	case whitespaceAction:
@@ -2948,37 +5662,62 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 		}
 
 	case newlineAction:
+		expected := a.expected()
 		return func(s *parserState) bool {
-			if atEnd(s) {
-				return false // eof is not a newline
+			// eof is not a newline
+			if !atEnd(s) && acceptNewline(s) {
+				return true
 			}
-			return acceptNewline(s)
+			expectState(s, expected)
+			return false
 		}
 
 	case endOfLineAction:
+		expected := a.expected()
 		return func(s *parserState) bool {
 			if atEnd(s) {
 				return true // eof is eol
 			}
-			return acceptNewline(s)
+			if acceptNewline(s) {
+				return true
+			}
+			expectState(s, expected)
+			return false
 		}
 
 	case startOfLineAction:
+		expected := a.expected()
 		return func(s *parserState) bool {
-			return s.lineStart == s.offset
+			if s.lineStart == s.offset {
+				return true
+			}
+			expectState(s, expected)
+			return false
 		}
 	case startOfFileAction:
+		expected := a.expected()
 		return func(s *parserState) bool {
-			return s.offset == 0
+			if s.offset == 0 {
+				return true
+			}
+			expectState(s, expected)
+			return false
 		}
 	case endOfFileAction:
+		expected := a.expected()
 		return func(s *parserState) bool {
-			return s.offset == s.i.length
+			if atEnd(s) {
+				return true
+			}
+			expectState(s, expected)
+			return false
 		}
 
 	case runeAction:
+		expected := a.expected()
 		return func(s *parserState) bool {
 			if atEnd(s) {
+				expectState(s, expected)
 				return false
 			}
 			_, n := peekRune(s)
@@ -2986,29 +5725,79 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 			return true
 		}
 	case byteAction:
+		expected := a.expected()
 		return func(s *parserState) bool {
 			if atEnd(s) {
+				expectState(s, expected)
 				return false
 			}
 			advanceState(s, 1)
 			return true
 		}
 	case stringAction:
+		expected := a.expected()
 		return func(s *parserState) bool {
 			for _, v := range a.strings {
 				if acceptString(s, v) {
 					return true
 				}
 			}
+			expectState(s, expected)
+			return false
+		}
+	case stringFoldAction:
+		folded := make([][]rune, len(a.strings))
+		for i, v := range a.strings {
+			folded[i] = []rune(foldString(v))
+		}
+		expected := a.expected()
+		return func(s *parserState) bool {
+			for _, v := range folded {
+				if acceptStringFold(s, v) {
+					return true
+				}
+			}
+			expectState(s, expected)
+			return false
+		}
+	case matchStringFoldAction:
+		rules := make(map[string]parseFunc, len(a.stringSwitch))
+		size := 0
+		for i, r := range a.stringSwitch {
+			rules[i] = buildAction(c, r)
+			if n := utf8.RuneCountInString(i); n > size {
+				size = n
+			}
+		}
+		expected := a.expected()
+		return func(s *parserState) bool {
+			if !atEnd(s) {
+				// fold as many runes as the longest key, like MatchString
+				b := peekString(s, size*utf8.UTFMax)
+				key := make([]rune, 0, size)
+				for _, r := range b {
+					if len(key) == size {
+						break
+					}
+					key = append(key, foldRune(r))
+				}
+				if fn, ok := rules[string(key)]; ok {
+					return fn(s)
+				}
+			}
+
+			expectState(s, expected)
 			return false
 		}
 	case byteListAction, byteStringAction:
+		expected := a.expected()
 		return func(s *parserState) bool {
 			for _, v := range a.bytes {
 				if acceptBytes(s, v) {
 					return true
 				}
 			}
+			expectState(s, expected)
 			return false
 		}
 	case matchStringAction:
@@ -3020,16 +5809,17 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 				size = len(i)
 			}
 		}
+		expected := a.expected()
 		return func(s *parserState) bool {
-			if atEnd(s) {
-				return false
-			}
-			r := peekString(s, size)
+			if !atEnd(s) {
+				r := peekString(s, size)
 
-			if fn, ok := rules[r]; ok {
-				return fn(s)
+				if fn, ok := rules[r]; ok {
+					return fn(s)
+				}
 			}
 
+			expectState(s, expected)
 			return false
 		}
 	case matchRuneAction:
@@ -3037,16 +5827,17 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 		for i, r := range a.runeSwitch {
 			rules[i] = buildAction(c, r)
 		}
+		expected := a.expected()
 		return func(s *parserState) bool {
-			if atEnd(s) {
-				return false
-			}
-			r, _ := peekRune(s)
+			if !atEnd(s) {
+				r, _ := peekRune(s)
 
-			if fn, ok := rules[r]; ok {
-				return fn(s)
+				if fn, ok := rules[r]; ok {
+					return fn(s)
+				}
 			}
 
+			expectState(s, expected)
 			return false
 		}
 	case matchByteAction:
@@ -3054,20 +5845,22 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 		for i, r := range a.byteSwitch {
 			rules[i] = buildAction(c, r)
 		}
+		expected := a.expected()
 		return func(s *parserState) bool {
-			if atEnd(s) {
-				return false
-			}
-			r := peekByte(s)
+			if !atEnd(s) {
+				r := peekByte(s)
 
-			if fn, ok := rules[r]; ok {
-				return fn(s)
+				if fn, ok := rules[r]; ok {
+					return fn(s)
+				}
 			}
 
+			expectState(s, expected)
 			return false
 		}
-	case runeExceptAction, runeRangeAction:
+	case runeExceptAction, runeRangeAction, runeRangeFoldAction:
 		inverted := a.inverted
+		fold := a.kind == runeRangeFoldAction
 		runeRanges := make([][]rune, len(a.ranges))
 		for i, v := range a.ranges {
 			n := []rune(v)
@@ -3077,8 +5870,10 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 				runeRanges[i] = []rune{n[0], n[2]}
 			}
 		}
+		expected := a.expected()
 		return func(s *parserState) bool {
 			if atEnd(s) {
+				expectState(s, expected)
 				return false
 			}
 			r, size := peekRune(s)
@@ -3091,6 +5886,17 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 					break
 				}
 			}
+			if fold && !result {
+			orbit:
+				for f := unicode.SimpleFold(r); f != r; f = unicode.SimpleFold(f) {
+					for _, v := range runeRanges {
+						if f >= v[0] && f <= v[1] {
+							result = true
+							break orbit
+						}
+					}
+				}
+			}
 			if inverted {
 				result = !result
 			}
@@ -3100,6 +5906,22 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 				return true
 			}
 
+			expectState(s, expected)
+			return false
+		}
+	case runeClassAction, runeScriptAction, runeIdentStartAction, runeIdentContinueAction, runeWhitespaceAction:
+		include, exclude := runeClassTables(a)
+		expected := a.expected()
+		return func(s *parserState) bool {
+			if !atEnd(s) {
+				r, size := peekRune(s)
+				if unicode.In(r, include...) && !unicode.In(r, exclude...) {
+					advanceState(s, size)
+					return true
+				}
+			}
+
+			expectState(s, expected)
 			return false
 		}
 	case byteExceptAction, byteRangeAction:
@@ -3113,8 +5935,10 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 				byteRanges[i] = []byte{n[0], n[2]}
 			}
 		}
+		expected := a.expected()
 		return func(s *parserState) bool {
 			if atEnd(s) {
+				expectState(s, expected)
 				return false
 			}
 			r := peekByte(s)
@@ -3136,231 +5960,841 @@ func buildAction(c *grammarConfig, a *parseAction) parseFunc {
 				return true
 			}
 
+			expectState(s, expected)
+			return false
+		}
+	case optionalAction:
+		rules := make([]parseFunc, len(a.args))
+		for i, r := range a.args {
+			rules[i] = buildAction(c, r)
+		}
+		return func(s *parserState) bool {
+			var s1 parserState
+			copyState(s, &s1)
+			m := pushMark(s)
+			for _, r := range rules {
+				if !r(&s1) {
+					popMark(s, m)
+					return true
+				}
+			}
+			popMark(s, m)
+			mergeState(s, &s1)
+			return true
+		}
+	case lookaheadAction:
+		rules := make([]parseFunc, len(a.args))
+		for i, r := range a.args {
+			rules[i] = buildAction(c, r)
+		}
+		return func(s *parserState) bool {
+			var s1 parserState
+			copyState(s, &s1)
+			m := pushMark(s)
+			for _, r := range rules {
+				if !r(&s1) {
+					popMark(s, m)
+					return false
+				}
+			}
+			popMark(s, m)
+			return true
+		}
+	case rejectAction:
+		rules := make([]parseFunc, len(a.args))
+		for i, r := range a.args {
+			rules[i] = buildAction(c, r)
+		}
+		return func(s *parserState) bool {
+			var s1 parserState
+			copyState(s, &s1)
+
+			// what a rejected rule expects isn't worth reporting
+			s.i.quiet++
+			m := pushMark(s)
+			matched := true
+			for _, r := range rules {
+				if !r(&s1) {
+					matched = false
+					break
+				}
+			}
+			popMark(s, m)
+			s.i.quiet--
+			return !matched
+		}
+
+	case repeatAction:
+		rules := make([]parseFunc, len(a.args))
+		for i, r := range a.args {
+			rules[i] = buildAction(c, r)
+		}
+		min_n := a.min
+		max_n := a.max
+		name := a.name
+
+		return func(s *parserState) bool {
+			min_n, max_n := min_n, max_n
+			if name != "" {
+				n, ok := s.bindings.lookupCount(name)
+				if !ok {
+					return false
+				} else if n == 0 {
+					return true
+				}
+				min_n, max_n = n, n
+			}
+
+			c := 0
+			var s1 parserState
+			copyState(s, &s1)
+			m := pushMark(s)
+			for {
+				start := s1.offset
+
+				for _, r := range rules {
+					if !r(&s1) {
+						popMark(s, m)
+						return c >= min_n
+					}
+				}
+
+				if s1.offset == start {
+					// reject zero width matches
+					break
+				}
+
+				c++
+
+				if c >= min_n {
+					mergeState(s, &s1)
+					setMark(s, m)
+				}
+
+				if max_n != 0 && c >= max_n {
+					break
+				}
+			}
+
+			popMark(s, m)
+			return c >= min_n
+		}
+
+	case cutAction:
+		return func(s *parserState) bool {
+			s.i.choiceExit = true
+			if s.i.reader != nil && s.i.choiceMark < len(s.i.marks) {
+				// the choice won't backtrack past here
+				s.i.marks[s.i.choiceMark] = s.offset
+			}
+			return true
+		}
+	case choiceAction:
+		rules := make([]parseFunc, len(a.args))
+		for i, r := range a.args {
+			rules[i] = buildAction(c, r)
+		}
+		return func(s *parserState) bool {
+			oldExit := s.i.choiceExit
+			oldCorner := s.i.corner
+			oldMark := s.i.choiceMark
+			m := pushMark(s)
+			s.i.choiceMark = m
+			for _, r := range rules {
+				var s1 parserState
+				copyState(s, &s1)
+				s.i.corner = oldCorner
+				s1.i.choiceExit = false
+				if r(&s1) {
+					mergeState(s, &s1)
+					s.i.choiceExit = oldExit
+					s.i.choiceMark = oldMark
+					popMark(s, m)
+					return true
+				}
+				trimState(s, &s1)
+				if s1.i.choiceExit {
+					break
+				}
+			}
+			s.i.corner = oldCorner
+			s.i.choiceExit = oldExit
+			s.i.choiceMark = oldMark
+			popMark(s, m)
 			return false
 		}
-	case optionalAction:
+
+	case lexemeAction:
+		rules := make([]parseFunc, len(a.args))
+		for i, r := range a.args {
+			rules[i] = buildAction(c, r)
+		}
+		return func(s *parserState) bool {
+			oldLexeme := s.lexeme
+			s.lexeme = true
+			for _, r := range rules {
+				if !r(s) {
+					s.lexeme = oldLexeme
+					return false
+				}
+			}
+			s.lexeme = oldLexeme
+			return true
+		}
+
+	case doAction, caseAction, sequenceAction:
 		rules := make([]parseFunc, len(a.args))
 		for i, r := range a.args {
 			rules[i] = buildAction(c, r)
 		}
+
+		if len(rules) == 0 {
+			return func(s *parserState) bool { return true }
+		}
+
+		if len(rules) == 1 {
+			return rules[0]
+		}
+
 		return func(s *parserState) bool {
 			var s1 parserState
 			copyState(s, &s1)
 			for _, r := range rules {
 				if !r(&s1) {
-					return true
+					return false
 				}
 			}
 			mergeState(s, &s1)
 			return true
 		}
-	case lookaheadAction:
+	case captureAction:
 		rules := make([]parseFunc, len(a.args))
 		for i, r := range a.args {
 			rules[i] = buildAction(c, r)
 		}
 		return func(s *parserState) bool {
 			var s1 parserState
-			copyState(s, &s1)
+			startCapture(s, &s1)
+			m := pushMark(s)
 			for _, r := range rules {
 				if !r(&s1) {
+					popMark(s, m)
 					return false
 				}
 			}
+			popMark(s, m)
+			mergeCapture(s, a.name, &s1)
 			return true
 		}
-	case rejectAction:
+	case bindAction:
 		rules := make([]parseFunc, len(a.args))
 		for i, r := range a.args {
 			rules[i] = buildAction(c, r)
 		}
+		name := a.name
 		return func(s *parserState) bool {
 			var s1 parserState
 			copyState(s, &s1)
+			m := pushMark(s)
 			for _, r := range rules {
 				if !r(&s1) {
-					return true
+					popMark(s, m)
+					return false
 				}
 			}
-			return false
+			popMark(s, m)
+			value := bindString(s, s.offset, s1.offset)
+			s1.bindings = &binding{name: name, value: value, next: s1.bindings}
+			mergeState(s, &s1)
+			return true
 		}
-
-	case repeatAction:
-		rules := make([]parseFunc, len(a.args))
-		for i, r := range a.args {
-			rules[i] = buildAction(c, r)
+	case countAction, countHexAction:
+		name := a.name
+		base := 10
+		if a.kind == countHexAction {
+			base = 16
 		}
-		min_n := a.min
-		max_n := a.max
-
+		expected := a.expected()
 		return func(s *parserState) bool {
+			n := 0
 			c := 0
-			var s1 parserState
-			copyState(s, &s1)
-			for {
-				start := s1.offset
-
-				for _, r := range rules {
-					if !r(&s1) {
-						return c >= min_n
-					}
-				}
-
-				if s1.offset == start {
-					// reject zero width matches
+			for i := s.offset; i < s.i.length || fill(s, i+1); i++ {
+				d := hexDigit(s.i.buf[i-s.i.base])
+				if d < 0 || d >= base {
 					break
 				}
-
+				if n > (maxInt-d)/base {
+					return false // overflow
+				}
+				n = n*base + d
 				c++
-
-				if c >= min_n {
-					mergeState(s, &s1)
+			}
+			if c == 0 {
+				expectState(s, expected)
+				return false
+			}
+			value := bindString(s, s.offset, s.offset+c)
+			advanceState(s, c)
+			s.bindings = &binding{name: name, value: value, count: n, counted: true, next: s.bindings}
+			return true
+		}
+	case countBigEndianAction, countLittleEndianAction:
+		name := a.name
+		width := a.min
+		bigEndian := a.kind == countBigEndianAction
+		expected := a.expected()
+		return func(s *parserState) bool {
+			if !fill(s, s.offset+width) {
+				expectState(s, expected)
+				return false
+			}
+			value := bindString(s, s.offset, s.offset+width)
+			var n uint64
+			for i := 0; i < width; i++ {
+				b := value[i]
+				if !bigEndian {
+					b = value[width-1-i]
 				}
-
-				if max_n != 0 && c >= max_n {
-					break
+				n = n<<8 | uint64(b)
+			}
+			if n > uint64(maxInt) {
+				return false
+			}
+			advanceState(s, width)
+			s.bindings = &binding{name: name, value: value, count: int(n), counted: true, next: s.bindings}
+			return true
+		}
+	case predicateAction:
+		fn := a.predicate
+		return func(s *parserState) bool {
+			return fn(&MatchContext{s: s})
+		}
+	case tokenAction:
+		prefix := a.pos
+		kinds := a.strings
+		fn := c.logFunc
+		return func(s *parserState) bool {
+			i := nextToken(s)
+			if i >= len(s.i.tokens) {
+				expectState(s, kinds)
+				return false
+			}
+			t := &s.i.tokens[i]
+			for _, k := range kinds {
+				if t.Kind == k {
+					t.to.moveState(s)
+					if s.i.trace {
+						fn("%v: Token(%q) matched, at line %v, col %v\n", prefix, k, s.lineNumber, s.column)
+					}
+					return true
 				}
 			}
-
-			return c >= min_n
+			if s.i.trace {
+				fn("%v: Token(%q) failing, at line %v, col %v\n", prefix, kinds, s.lineNumber, s.column)
+			}
+			s1 := *s
+			t.from.moveState(&s1)
+			expectState(&s1, kinds)
+			return false
 		}
-
-	case cutAction:
+	case regexpAction:
+		re := a.re
+		expected := a.expected()
 		return func(s *parserState) bool {
-			s.i.choiceExit = true
+			fill(s, s.offset+readSize)
+			loc := re.FindStringIndex(s.i.buf[s.offset-s.i.base:])
+			if loc == nil {
+				expectState(s, expected)
+				return false
+			}
+			advanceState(s, loc[1])
 			return true
 		}
-	case choiceAction:
-		rules := make([]parseFunc, len(a.args))
-		for i, r := range a.args {
-			rules[i] = buildAction(c, r)
+	case matchAction:
+		prefix := a.pos
+		name := a.name
+		match := a.matcher
+		fn := c.logFunc
+		expected := a.expected()
+		return func(s *parserState) bool {
+			fill(s, s.offset+readSize)
+			n, ok := match(s.i.buf, s.offset-s.i.base)
+
+			if !ok || n <= 0 || s.offset+n > s.i.length {
+				if s.i.trace {
+					fn("%v: Match(%q) failing, at line %v, col %v\n", prefix, name, s.lineNumber, s.column)
+				}
+				expectState(s, expected)
+				return false
+			}
+
+			advanceState(s, n)
+			if s.i.trace {
+				fn("%v: Match(%q) matched, at line %v, col %v\n", prefix, name, s.lineNumber, s.column)
+			}
+			return true
 		}
+	case takeAction:
+		name := a.name
+		runes := c.textMode
 		return func(s *parserState) bool {
-			oldExit := s.i.choiceExit
-			oldCorner := s.i.corner
-			for _, r := range rules {
-				var s1 parserState
-				copyState(s, &s1)
-				s.i.corner = oldCorner
-				s1.i.choiceExit = false
-				if r(&s1) {
-					mergeState(s, &s1)
-					s.i.choiceExit = oldExit
-					return true
+			n, ok := s.bindings.lookupCount(name)
+			if !ok {
+				return false
+			}
+
+			length := n
+			if runes {
+				length = 0
+				for i := 0; i < n; i++ {
+					if !fill(s, s.offset+length+1) {
+						length = -1
+						break
+					}
+					fill(s, s.offset+length+utf8.UTFMax)
+					_, size := utf8.DecodeRuneInString(s.i.buf[s.offset+length-s.i.base:])
+					length += size
 				}
-				trimState(s, &s1)
-				if s1.i.choiceExit {
-					break
+			}
+
+			if length < 0 || !fill(s, s.offset+length) {
+				unit := "bytes"
+				if runes {
+					unit = "characters"
 				}
+				expectState(s, []string{fmt.Sprintf("%v %v", n, unit)})
+				return false
 			}
-			s.i.corner = oldCorner
-			s.i.choiceExit = oldExit
+			advanceState(s, length)
+			return true
+		}
+	case backrefAction:
+		name := a.name
+		return func(s *parserState) bool {
+			value, ok := s.bindings.lookup(name)
+			if !ok {
+				return false
+			}
+			if acceptString(s, value) {
+				return true
+			}
+			expectState(s, []string{fmt.Sprintf("%q", value)})
 			return false
 		}
+	default:
+		return func(s *parserState) bool {
+			return true
+		}
+	}
+}
+
+type Parser struct {
+	rules    []parseFunc
+	config   *grammarConfig
+	builders map[string]any
+	err      error
+}
+
+func (p *Parser) Err() error {
+	return p.err
+}
+
+func (p *Parser) newParserState(s string) *parserState {
+	i := &parserInput{
+		rules:   p.rules,
+		buf:     s,
+		length:  len(s),
+		tabstop: p.config.tabstop,
+		runes:   p.config.runeColumns,
+		nodes:   make([]Node, 128),
+		trace:   false,
+		starts:  make(map[int]int, len(p.rules)),
+		inside:  make(map[int]int, len(p.rules)),
+
+		choiceMark: -1,
+	}
+	return &parserState{i: i}
+}
+
+func (p *Parser) newTokenState(s string) *parserState {
+	state := p.newParserState(s)
+	if p.config.lexer != nil {
+		// a failure to lex is reported like a failure to read
+		tokens, err := p.config.lexer.lex(p.config.lexer.parser.newParserState(s))
+		state.i.tokens = tokens
+		state.i.tokenMode = true
+		state.i.readErr = err
+	}
+	return state
+}
+
+func (p *Parser) newReaderState(r io.Reader) *parserState {
+	s := p.newParserState("")
+	s.i.reader = r
+	return s
+}
+
+func (p *Parser) ParseTree(s string) (*ParseTree, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	return p.parseTree(p.newTokenState(s), p.config.startIdx)
+}
+
+// ParsePrefix parses the start of the input, and returns how many
+// bytes were consumed, rather than failing on trailing input. In
+// TokenMode, trailing input that can't be lexed is ignored too
+
+func (p *Parser) ParsePrefix(s string) (*ParseTree, int, error) {
+	if p.err != nil {
+		return nil, 0, p.err
+	}
+	state := p.newTokenState(s)
+	start := *state
+	rule := p.rules[p.config.startIdx]
+
+	if !rule(state) {
+		return nil, 0, p.parseFailure(state)
+	}
+	p.skipTrailing(state)
+	if f, ok := state.i.readErr.(*ParseFailure); ok && state.i.tokenMode && f.Offset >= state.offset {
+		// the lexer stopped after the prefix, so it doesn't matter
+		state.i.readErr = nil
+	}
+	if state.i.readErr != nil {
+		return nil, 0, state.i.readErr
+	}
+
+	n := state.finalNode(p.config.start, &start)
+	return newParseTree(state, n), state.offset, nil
+}
+
+// ParseTreeRule parses the input with the named rule, instead of the
+// start rule of the grammar
+
+func (p *Parser) ParseTreeRule(name string, s string) (*ParseTree, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	idx, err := p.ruleIndex(name)
+	if err != nil {
+		return nil, err
+	}
+	return p.parseTree(p.newTokenState(s), idx)
+}
+
+// ParseTreeReader parses input as it is read. The tree needs the text
+// of every node, so all of the input stays buffered until the end. Use
+// ParseEach to throw away each record once it has been handled
+
+func (p *Parser) ParseTreeReader(r io.Reader) (*ParseTree, error) {
+	if p.err != nil {
+		return nil, p.err
+	} else if p.config.lexer != nil {
+		return nil, errTokenReader
+	}
+	return p.parseTree(p.newReaderState(r), p.config.startIdx)
+}
+
+func (p *Parser) ruleIndex(name string) (int, error) {
+	idx, ok := p.config.index[name]
+	if !ok {
+		return 0, fmt.Errorf("no rule called %q", name)
+	}
+	return idx, nil
+}
+
+func (p *Parser) parseTree(state *parserState, idx int) (*ParseTree, error) {
+	start := *state
+	rule := p.rules[idx]
+	pushMark(state) // keep the input for the top level node
+
+	if !rule(state) {
+		return nil, p.parseFailure(state)
+	}
+	p.skipTrailing(state)
+	if !atEnd(state) {
+		// the rule matched, but left trailing input
+		expectState(state, []string{"end of file"})
+		return nil, p.parseFailure(state)
+	}
+	if state.i.readErr != nil {
+		return nil, state.i.readErr
+	}
+
+	n := state.finalNode(p.config.names[idx], &start)
+	return newParseTree(state, n), nil
+}
+
+func (p *Parser) parseFailure(s *parserState) error {
+	if s.i.readErr != nil {
+		return s.i.readErr
+	}
+	f := &s.i.fail
+	rules := make([]string, len(f.stack))
+	for i, idx := range f.stack {
+		rules[i] = p.config.names[idx]
+	}
+
+	return &ParseFailure{
+		Offset:    f.offset,
+		Line:      f.line + 1,
+		Column:    f.column + 1,
+		Rules:     rules,
+		Expected:  append([]string(nil), f.expected...),
+		buf:       s.i.buf,
+		base:      s.i.base,
+		lineStart: f.lineStart,
+		tabstop:   s.i.tabstop,
+	}
+}
+
+func (p *Parser) Parse(s string) (any, error) {
+	return p.ParseWith(s, nil)
+}
+
+// ParseWith is like Parse, but passes state to every builder
+// that takes a *BuildContext
+
+func (p *Parser) ParseWith(s string, state any) (any, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	tree, err := p.ParseTree(s)
+	return p.build(tree, err, state)
+}
+
+func (p *Parser) ParseRule(name string, s string) (any, error) {
+	return p.ParseRuleWith(name, s, nil)
+}
+
+// ParseRuleWith is like ParseRule, but passes state to the builders
+
+func (p *Parser) ParseRuleWith(name string, s string, state any) (any, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	tree, err := p.ParseTreeRule(name, s)
+	return p.build(tree, err, state)
+}
+
+func (p *Parser) ParseReader(r io.Reader) (any, error) {
+	return p.ParseReaderWith(r, nil)
+}
+
+// ParseReaderWith is like ParseReader, but passes state to the builders
+
+func (p *Parser) ParseReaderWith(r io.Reader, state any) (any, error) {
+	if p.err != nil {
+		return nil, p.err
+	}
+	tree, err := p.ParseTreeReader(r)
+	return p.build(tree, err, state)
+}
+
+func (p *Parser) build(tree *ParseTree, err error, state any) (any, error) {
+	if err != nil {
+		return nil, err
+	}
 
-	case doAction, caseAction, sequenceAction:
-		rules := make([]parseFunc, len(a.args))
-		for i, r := range a.args {
-			rules[i] = buildAction(c, r)
-		}
+	if p.builders == nil {
+		return tree, nil
+	}
+	return tree.BuildWith(p.builders, state)
+}
 
-		if len(rules) == 0 {
-			return func(s *parserState) bool { return true }
-		}
+// ParseEach parses the input one record at a time, calling fn with
+// the tree for each record. Each tree gets a fresh set of nodes, but
+// line numbers still count from the start of the input
 
-		if len(rules) == 1 {
-			return rules[0]
+func (p *Parser) ParseEach(r io.Reader, rule string, fn func(*ParseTree) error) error {
+	if p.err != nil {
+		return p.err
+	} else if p.config.lexer != nil {
+		return errTokenReader
+	}
+	idx, err := p.ruleIndex(rule)
+	if err != nil {
+		return err
+	}
+	parse := p.rules[idx]
+	state := p.newReaderState(r)
+
+	for {
+		p.skipTrailing(state)
+		if atEnd(state) {
+			break
 		}
+		state.captureStart = state.offset
+		start := *state
+		m := pushMark(state) // keep the input for the whole record
 
-		return func(s *parserState) bool {
-			var s1 parserState
-			copyState(s, &s1)
-			for _, r := range rules {
-				if !r(&s1) {
-					return false
-				}
-			}
-			mergeState(s, &s1)
-			return true
+		if !parse(state) {
+			return p.parseFailure(state)
 		}
-	case captureAction:
-		rules := make([]parseFunc, len(a.args))
-		for i, r := range a.args {
-			rules[i] = buildAction(c, r)
+		if state.offset == start.offset {
+			// the record matched nothing, and would forever
+			expectState(state, []string{"end of file"})
+			return p.parseFailure(state)
 		}
-		return func(s *parserState) bool {
-			var s1 parserState
-			startCapture(s, &s1)
-			for _, r := range rules {
-				if !r(&s1) {
-					return false
-				}
-			}
-			mergeCapture(s, a.name, &s1)
-			return true
+		if state.i.readErr != nil {
+			return state.i.readErr
 		}
-	default:
-		return func(s *parserState) bool {
-			return true
+
+		n := state.finalNode(rule, &start)
+		tree := newParseTree(state, n)
+		popMark(state, m)
+
+		// start the next record afresh
+		state.i.nodes = make([]Node, 128)
+		state.i.memo = nil
+		state.i.fail = parserFailure{}
+		state.numNodes = 0
+		state.lastSibling = 0
+		state.countSibling = 0
+
+		if err := fn(tree); err != nil {
+			return err
 		}
 	}
+	return state.i.readErr
 }
 
-type Parser struct {
-	rules    []parseFunc
-	config   *grammarConfig
-	builders map[string]any
-	err      error
+var errTokenReader = errors.New("token mode cannot parse from a reader")
+
+//
+//	Lexer
+//
+
+type Lexer struct {
+	parser *Parser
+	kinds  []int // the rules for each kind of token
+	err    error
 }
 
-func (p *Parser) Err() error {
-	return p.err
+// Token is a kind of token, and where it was found in the input
+
+type Token struct {
+	Kind   string
+	Start  int
+	End    int
+	Line   int // 1-based
+	Column int // 1-based
+
+	from textPosition
+	to   textPosition
 }
 
-func (p *Parser) newParserState(s string) *parserState {
-	i := &parserInput{
-		rules:   p.rules,
-		buf:     s,
-		length:  len(s),
-		tabstop: p.config.tabstop,
-		nodes:   make([]Node, 128),
-		trace:   false,
-		starts:  make(map[int]int, len(p.rules)),
-		inside:  make(map[int]int, len(p.rules)),
-	}
-	return &parserState{i: i}
+type textPosition struct {
+	offset     int
+	column     int
+	lineStart  int
+	lineNumber int
+	lineIndent int
 }
 
-func (p *Parser) ParseTree(s string) (*ParseTree, error) {
-	if p.err != nil {
-		return nil, p.err
+func positionOf(s *parserState) textPosition {
+	return textPosition{
+		offset:     s.offset,
+		column:     s.column,
+		lineStart:  s.lineStart,
+		lineNumber: s.lineNumber,
+		lineIndent: s.lineIndent,
 	}
-	state := p.newParserState(s)
-	rule := p.rules[p.config.startIdx]
+}
 
-	complete := rule(state) && atEnd(state)
-	if complete {
-		n := state.finalNode(p.config.start)
-		return &ParseTree{root: n, buf: s, nodes: state.i.nodes}, nil
-	}
-	return nil, ParseError
+func (t textPosition) moveState(s *parserState) {
+	s.offset = t.offset
+	s.column = t.column
+	s.lineStart = t.lineStart
+	s.lineNumber = t.lineNumber
+	s.lineIndent = t.lineIndent
 }
 
-func (p *Parser) Parse(s string) (any, error) {
-	if p.err != nil {
-		return nil, p.err
-	}
+// nextToken is the index of the first token at or after the offset
 
-	tree, err := p.ParseTree(s)
+func nextToken(s *parserState) int {
+	tokens := s.i.tokens
+	return sort.Search(len(tokens), func(i int) bool {
+		return tokens[i].Start >= s.offset
+	})
+}
 
+func (l *Lexer) Err() error {
+	return l.err
+}
+
+// Lex returns every token in the input, picking the longest match at
+// each offset, or the kind defined first when two are the same length
+
+func (l *Lexer) Lex(s string) ([]Token, error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+	tokens, err := l.lex(l.parser.newParserState(s))
 	if err != nil {
 		return nil, err
 	}
+	return tokens, nil
+}
 
-	if p.builders == nil {
-		return tree, nil
+func (l *Lexer) kindIndex(kind string) int {
+	for i, k := range l.kinds {
+		if l.parser.config.names[k] == kind {
+			return i
+		}
+	}
+	return -1
+}
+
+func (l *Lexer) lex(s *parserState) ([]Token, error) {
+	if l.err != nil {
+		return nil, l.err
+	}
+	p := l.parser
+	tokens := []Token{}
+
+	for {
+		if p.config.trivia {
+			skipTrivia(s, p.config.triviaIdx)
+		}
+		if atEnd(s) {
+			break
+		}
+
+		found := -1
+		var best parserState
+		for _, k := range l.kinds {
+			var s1 parserState
+			copyState(s, &s1)
+			if p.rules[k](&s1) && s1.offset > s.offset && (found < 0 || s1.offset > best.offset) {
+				found = k
+				best = s1
+			}
+		}
+
+		if found < 0 {
+			// keep the tokens before the failure, for ParsePrefix
+			return tokens, p.parseFailure(s)
+		}
+
+		tokens = append(tokens, Token{
+			Kind:   p.config.names[found],
+			Start:  s.offset,
+			End:    best.offset,
+			Line:   s.lineNumber + 1,
+			Column: s.column + 1,
+			from:   positionOf(s),
+			to:     positionOf(&best),
+		})
+
+		// tokens don't keep any captures
+		mergeState(s, &best)
+		s.numNodes = 0
+		s.lastSibling = 0
+		s.countSibling = 0
 	}
-	return tree.Build(p.builders)
+	return tokens, nil
 }
 
 func (p *Parser) testGrammar(accept []string, reject []string) bool {
@@ -3388,16 +6822,24 @@ func (p *Parser) testParseFunc(rule parseFunc, accept []string, reject []string)
 		return false
 	}
 	for _, s := range accept {
-		state := p.newParserState(s)
-		complete := rule(state) && atEnd(state)
+		state := p.newTokenState(s)
+		matched := rule(state)
+		if matched {
+			p.skipTrailing(state)
+		}
+		complete := matched && atEnd(state) && state.i.readErr == nil
 
 		if !complete {
 			return false
 		}
 	}
 	for _, s := range reject {
-		state := p.newParserState(s)
-		complete := rule(state) && atEnd(state)
+		state := p.newTokenState(s)
+		matched := rule(state)
+		if matched {
+			p.skipTrailing(state)
+		}
+		complete := matched && atEnd(state) && state.i.readErr == nil
 
 		if complete {
 			return false
@@ -3410,6 +6852,9 @@ type Node struct {
 	name     string
 	start    int
 	end      int
+	line     int
+	column   int
+	parent   int // set once the tree is built
 	child    int
 	nchild   int
 	sibling  int
@@ -3417,6 +6862,30 @@ type Node struct {
 	// children []int
 }
 
+func (n *Node) Name() string {
+	return n.name
+}
+
+// Span returns the start and end offsets of the node, in bytes
+
+func (n *Node) Span() (int, int) {
+	return n.start, n.end
+}
+
+func (n *Node) Text(t *ParseTree) string {
+	return t.text(n)
+}
+
+// Line and Column are where the node starts, counting from 1
+
+func (n *Node) Line() int {
+	return n.line + 1
+}
+
+func (n *Node) Column() int {
+	return n.column + 1
+}
+
 func (n *Node) children(t *ParseTree) []int {
 	children := make([]int, n.nchild)
 	c := n.child
@@ -3430,10 +6899,64 @@ func (n *Node) children(t *ParseTree) []int {
 
 type ParseTree struct {
 	buf   string
+	base  int // offset of buf, when the input was read
 	nodes []Node
 	root  int
 }
 
+func newParseTree(s *parserState, root int) *ParseTree {
+	t := &ParseTree{
+		root:  root,
+		buf:   s.i.buf,
+		base:  s.i.base,
+		nodes: s.i.nodes[:s.numNodes],
+	}
+
+	t.nodes[root].parent = -1
+	stack := []int{root}
+	for len(stack) > 0 {
+		i := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+
+		n := &t.nodes[i]
+		c := n.child
+		for j := 0; j < n.nchild; j++ {
+			t.nodes[c].parent = i
+			stack = append(stack, c)
+			c = t.nodes[c].sibling
+		}
+	}
+	return t
+}
+
+func (t *ParseTree) Root() *Node {
+	return &t.nodes[t.root]
+}
+
+func (t *ParseTree) Children(n *Node) []*Node {
+	children := make([]*Node, n.nchild)
+	c := n.child
+
+	for j := 0; j < n.nchild; j++ {
+		children[j] = &t.nodes[c]
+		c = t.nodes[c].sibling
+	}
+	return children
+}
+
+// Parent returns nil for the root node
+
+func (t *ParseTree) Parent(n *Node) *Node {
+	if n.parent < 0 {
+		return nil
+	}
+	return &t.nodes[n.parent]
+}
+
+func (t *ParseTree) text(n *Node) string {
+	return t.buf[n.start-t.base : n.end-t.base]
+}
+
 func (t *ParseTree) children(i int) []int {
 	n := t.nodes[i]
 	children := make([]int, n.nchild)
@@ -3446,6 +6969,9 @@ func (t *ParseTree) children(i int) []int {
 	return children
 }
 
+// Walk calls f on every node after its children, so the root comes
+// last. Use Visit to see a node before its children as well
+
 func (t *ParseTree) Walk(f func(*Node)) {
 	var walk func(int)
 
@@ -3462,7 +6988,76 @@ func (t *ParseTree) Walk(f func(*Node)) {
 	walk(t.root)
 }
 
+// Visitor is called on the way into and out of every node, and Enter
+// can return true to skip over the children of a node. Depth is zero
+// for the root node
+
+type Visitor interface {
+	Enter(n *Node, depth int) (skipChildren bool)
+	Exit(n *Node, depth int)
+}
+
+func (t *ParseTree) Visit(v Visitor) {
+	var visit func(int, int)
+
+	visit = func(i int, depth int) {
+		n := &t.nodes[i]
+		if !v.Enter(n, depth) {
+			c := n.child
+			for i := 0; i < n.nchild; i++ {
+				visit(c, depth+1)
+				c = t.nodes[c].sibling
+			}
+		}
+		v.Exit(n, depth)
+	}
+	visit(t.root, 0)
+}
+
+// BuildContext is passed to builders like func(*BuildContext, []any) (any, error),
+// instead of the text of the node
+
+type BuildContext struct {
+	Tree  *ParseTree
+	Node  *Node
+	State any // passed to ParseWith or BuildWith
+}
+
+func (c *BuildContext) Name() string {
+	return c.Node.name
+}
+
+func (c *BuildContext) Text() string {
+	return c.Tree.text(c.Node)
+}
+
+func (c *BuildContext) Span() (int, int) {
+	return c.Node.start, c.Node.end
+}
+
+func (c *BuildContext) Line() int {
+	return c.Node.Line()
+}
+
+func (c *BuildContext) Column() int {
+	return c.Node.Column()
+}
+
+func (c *BuildContext) Children() []*Node {
+	return c.Tree.Children(c.Node)
+}
+
 func (t *ParseTree) Build(builders map[string]any) (any, error) {
+	return t.BuildWith(builders, nil)
+}
+
+// BuildWith is like Build, but passes state to every builder
+// that takes a *BuildContext
+
+func (t *ParseTree) BuildWith(builders map[string]any, state any) (any, error) {
+	// other builders are wrapped once, the first time they're used
+	reflected := make(map[string]reflectedBuilder)
+
 	var build func(int) (any, error)
 
 	build = func(i int) (any, error) {
@@ -3479,13 +7074,222 @@ func (t *ParseTree) Build(builders map[string]any) (any, error) {
 				return nil, err
 			}
 		}
+
+		var out any
 		fn := builders[n.name]
 		switch v := fn.(type) {
 		case func(string, []any) (any, error):
-			return v(t.buf[n.start:n.end], args)
+			out, err = v(t.text(n), args)
+		case func(*BuildContext, []any) (any, error):
+			out, err = v(&BuildContext{Tree: t, Node: n, State: state}, args)
+		case nil:
+			err = errors.New("no builder")
 		default:
-			return nil, errors.New("no builder")
+			r, ok := reflected[n.name]
+			if !ok {
+				r.fn, r.err = reflectBuilder(v)
+				reflected[n.name] = r
+			}
+			err = r.err
+			if err == nil {
+				out, err = r.fn(&BuildContext{Tree: t, Node: n, State: state}, args)
+			}
+		}
+
+		if err != nil {
+			return nil, t.buildError(n, err)
 		}
+		return out, nil
 	}
 	return build(t.root)
 }
+
+type reflectedBuilder struct {
+	fn  func(*BuildContext, []any) (any, error)
+	err error
+}
+
+// BuildError is returned by ParseTree.Build when a builder fails, and
+// says which capture it was building and where it is in the input
+
+type BuildError struct {
+	Capture string
+	Start   int // in bytes
+	End     int
+	Line    int      // starts at 1
+	Column  int      // starts at 1
+	Parents []string // enclosing captures, outermost first
+	Err     error
+}
+
+func (e *BuildError) Error() string {
+	return fmt.Sprintf("line %v, col %v: building %q: %v", e.Line, e.Column, e.Capture, e.Err)
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+func (t *ParseTree) buildError(n *Node, err error) *BuildError {
+	var parents []string
+	for p := t.Parent(n); p != nil; p = t.Parent(p) {
+		parents = append([]string{p.name}, parents...)
+	}
+
+	return &BuildError{
+		Capture: n.name,
+		Start:   n.start,
+		End:     n.end,
+		Line:    n.Line(),
+		Column:  n.Column(),
+		Parents: parents,
+		Err:     err,
+	}
+}
+
+// Decode fills in v from the parse tree, a little like json.Unmarshal.
+// Struct fields are matched to captures by tags, like `ez:"key"`, and
+// a field tagged `ez:",text"` gets the text of the node itself. Slice
+// fields collect every matching child, pointer fields are left nil when
+// there's no match, and strings, numbers, and encoding.TextUnmarshaler
+// are filled in from the text of the node
+
+func (t *ParseTree) Decode(v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("cant decode into %T, need a non-nil pointer", v)
+	}
+	return t.decode(&t.nodes[t.root], rv.Elem())
+}
+
+var textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+var bytesType = reflect.TypeOf([]byte(nil))
+
+// isLeaf is true for types that get filled in from text, not children
+
+func isLeaf(t reflect.Type) bool {
+	return t == bytesType || reflect.PointerTo(t).Implements(textUnmarshalerType)
+}
+
+func (t *ParseTree) decode(n *Node, v reflect.Value) error {
+	text := t.text(n)
+
+	if v.Type() == bytesType {
+		v.SetBytes([]byte(text))
+		return nil
+	} else if v.CanAddr() && v.Addr().Type().Implements(textUnmarshalerType) {
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(text))
+	}
+
+	var err error
+
+	switch v.Kind() {
+	case reflect.Pointer:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return t.decode(n, v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("cant decode %q into %v", n.name, v.Type())
+		}
+		v.Set(reflect.ValueOf(text))
+	case reflect.String:
+		v.SetString(text)
+	case reflect.Bool:
+		var b bool
+		b, err = strconv.ParseBool(text)
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		var i int64
+		i, err = strconv.ParseInt(text, 0, v.Type().Bits())
+		v.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		var u uint64
+		u, err = strconv.ParseUint(text, 0, v.Type().Bits())
+		v.SetUint(u)
+	case reflect.Float32, reflect.Float64:
+		var f float64
+		f, err = strconv.ParseFloat(text, v.Type().Bits())
+		v.SetFloat(f)
+	case reflect.Slice:
+		children := t.Children(n)
+		s := reflect.MakeSlice(v.Type(), len(children), len(children))
+		for i, c := range children {
+			if err := t.decode(c, s.Index(i)); err != nil {
+				return err
+			}
+		}
+		v.Set(s)
+	case reflect.Struct:
+		return t.decodeStruct(n, v)
+	default:
+		return fmt.Errorf("cant decode %q into %v", n.name, v.Type())
+	}
+
+	if err != nil {
+		return fmt.Errorf("cant decode %q into %v: %w", n.name, v.Type(), err)
+	}
+	return nil
+}
+
+func (t *ParseTree) decodeStruct(n *Node, v reflect.Value) error {
+	children := t.Children(n)
+	vt := v.Type()
+
+	for i := 0; i < vt.NumField(); i++ {
+		field := vt.Field(i)
+		tag, ok := field.Tag.Lookup("ez")
+		if !ok || !field.IsExported() {
+			continue
+		}
+		fv := v.Field(i)
+
+		if tag == ",text" {
+			if err := t.decodeText(n, fv); err != nil {
+				return err
+			}
+			continue
+		}
+
+		var matches []*Node
+		for _, c := range children {
+			if c.name == tag {
+				matches = append(matches, c)
+			}
+		}
+
+		if fv.Kind() == reflect.Slice && !isLeaf(fv.Type()) {
+			s := reflect.MakeSlice(fv.Type(), len(matches), len(matches))
+			for j, c := range matches {
+				if err := t.decode(c, s.Index(j)); err != nil {
+					return err
+				}
+			}
+			fv.Set(s)
+			continue
+		}
+
+		switch len(matches) {
+		case 0:
+			// optional, so left as is
+		case 1:
+			if err := t.decode(matches[0], fv); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("capture %q matched %v times, but field %v isn't a slice", tag, len(matches), field.Name)
+		}
+	}
+	return nil
+}
+
+func (t *ParseTree) decodeText(n *Node, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Struct, reflect.Slice:
+		if !isLeaf(v.Type()) {
+			return fmt.Errorf("cant decode text of %q into %v", n.name, v.Type())
+		}
+	}
+	return t.decode(n, v)
+}
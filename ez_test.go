@@ -1,7 +1,12 @@
 package ez
 
 import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
 	"testing"
+	"testing/iotest"
 )
 
 // t.Log(...) / t.Logf("%v", err)
@@ -340,6 +345,258 @@ func TestRecursion(t *testing.T) {
 		t.Logf("test grammar worked")
 	}
 
+	// a Call() inside the brackets starts again at the lowest
+	// precedence, instead of keeping the one from the enclosing Recur()
+
+	parser := BuildParser(func(g *G) {
+		g.Start = "expr"
+
+		g.Define("expr").Recursive("expr").Choice(func() {
+			g.Corner("expr", 1)
+			g.Capture("add", func() {
+				g.Recur("expr")
+				g.String("+")
+				g.Stump("expr")
+			})
+		}, func() {
+			g.Corner("expr", 2)
+			g.Capture("mul", func() {
+				g.Recur("expr")
+				g.String("*")
+				g.Stump("expr")
+			})
+		}, func() {
+			g.NoCorner("expr", 3)
+			g.Choice(func() {
+				g.Capture("num", func() {
+					g.Rune().Range("0-9")
+				})
+			}, func() {
+				g.String("(")
+				g.Call("expr")
+				g.String(")")
+			})
+		})
+
+		g.Builder("add", func(s string, args []any) (any, error) {
+			return fmt.Sprintf("(%v+%v)", args[0], args[1]), nil
+		})
+		g.Builder("mul", func(s string, args []any) (any, error) {
+			return fmt.Sprintf("(%v*%v)", args[0], args[1]), nil
+		})
+		g.Builder("num", func(s string, args []any) (any, error) {
+			return s, nil
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	tests := map[string]string{
+		"1+2*3":       "(1+(2*3))",
+		"2*(1+3)":     "(2*(1+3))",
+		"(1+3)*2":     "((1+3)*2)",
+		"1+(2+3)":     "(1+(2+3))",
+		"2*(1*3+4)+5": "((2*((1*3)+4))+5)",
+	}
+
+	for input, want := range tests {
+		out, err := parser.Parse(input)
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", input, err)
+		} else if fmt.Sprint(out) != want {
+			t.Errorf("parsing %q, got %v, want %v", input, out, want)
+		}
+	}
+}
+
+func TestMutualRecursion(t *testing.T) {
+	parser := BuildParser(func(g *G) {
+		g.Start = "expr"
+
+		g.Define("expr").Do(func() {
+			g.Capture("expr", func() {
+				g.Call("postfix")
+			})
+		})
+		g.Define("primary").Recursive("primary", "postfix").Choice(func() {
+			g.Capture("field", func() {
+				g.Recur("postfix")
+				g.String(".")
+				g.Call("name")
+			})
+		}, func() {
+			g.Call("name")
+		})
+		g.Define("postfix").Recursive("primary", "postfix").Choice(func() {
+			g.Capture("incr", func() {
+				g.Recur("postfix")
+				g.String("++")
+			})
+		}, func() {
+			g.Recur("primary")
+		})
+		g.Define("name").Do(func() {
+			g.Capture("name", func() {
+				g.Repeat().Min(1).Do(func() {
+					g.Rune().Range("a-z")
+				})
+			})
+		})
+
+		g.Builder("field", func(s string, args []any) (any, error) {
+			return fmt.Sprintf("(%v.%v)", args[0], args[1]), nil
+		})
+		g.Builder("incr", func(s string, args []any) (any, error) {
+			return fmt.Sprintf("(%v++)", args[0]), nil
+		})
+		g.Builder("name", func(s string, args []any) (any, error) {
+			return s, nil
+		})
+		g.Builder("expr", func(s string, args []any) (any, error) {
+			return args[0], nil
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	ok := parser.testGrammar(
+		[]string{"a", "a++", "a.b", "a++.b", "a.b++", "a.b++.c++++"},
+		[]string{"a.", "++a", "a+", ".a", "a.++"},
+	)
+	if !ok {
+		t.Error("mutual recursion test case failed")
+	}
+
+	out, err := parser.Parse("ab.c++.d")
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	if fmt.Sprint(out) != "(((ab.c)++).d)" {
+		t.Errorf("wrong output: %v", out)
+	}
+
+	g := BuildGrammar(func(g *G) {
+		g.Start = "expr"
+		g.Define("expr").Recursive("expr", "term").Choice(func() {
+			g.Recur("term")
+			g.String("+")
+		}, func() {
+			g.String("1")
+		})
+		g.Define("term").Recursive("expr").Choice(func() {
+			g.Recur("expr")
+			g.String("*")
+		}, func() {
+			g.String("2")
+		})
+	})
+	if g.Err == nil {
+		t.Error("term should be required to be recursive with itself")
+	}
+}
+
+func TestOperators(t *testing.T) {
+	parser := BuildParser(func(g *G) {
+		g.Start = "expr"
+
+		g.Define("expr").Do(func() {
+			g.Capture("expr", func() {
+				g.Call("op")
+			})
+		})
+		g.Operators("op", func(op *OpTable) {
+			op.Space(func() {
+				g.Whitespace()
+			})
+			op.Right(1, "=")
+			op.Ternary(2, "?", ":")
+			op.NonAssoc(3, "<")
+			op.Left(4, "+", "-")
+			op.Left(5, "*")
+			op.Prefix(6, "-")
+			op.Postfix(7, "!")
+			op.Atom(func() {
+				g.Capture("number", func() {
+					g.Repeat().Min(1).Do(func() {
+						g.Rune().Range("0-9")
+					})
+				})
+			})
+			op.Atom(func() {
+				g.String("(")
+				g.Call("op")
+				g.String(")")
+			})
+		})
+
+		for _, o := range []string{"=", "<", "+", "-", "*"} {
+			o := o
+			g.Builder("_"+o+"_", func(s string, args []any) (any, error) {
+				return fmt.Sprintf("(%v%v%v)", args[0], o, args[1]), nil
+			})
+		}
+		g.Builder("-_", func(s string, args []any) (any, error) {
+			return fmt.Sprintf("(-%v)", args[0]), nil
+		})
+		g.Builder("_!", func(s string, args []any) (any, error) {
+			return fmt.Sprintf("(%v!)", args[0]), nil
+		})
+		g.Builder("_?_:_", func(s string, args []any) (any, error) {
+			return fmt.Sprintf("(%v?%v:%v)", args[0], args[1], args[2]), nil
+		})
+		g.Builder("number", func(s string, args []any) (any, error) {
+			return s, nil
+		})
+		g.Builder("expr", func(s string, args []any) (any, error) {
+			return args[0], nil
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	tests := map[string]string{
+		"1":                     "1",
+		"1+2*3":                 "(1+(2*3))",
+		"1*2+3":                 "((1*2)+3)",
+		"1-2-3":                 "((1-2)-3)",
+		"1 = 2 = 3":             "(1=(2=3))",
+		"-1!":                   "(-(1!))",
+		"--1*2":                 "((-(-1))*2)",
+		"2*(1+3)":               "(2*(1+3))",
+		"1 < 2 ? 3 : 4 ? 5 : 6": "((1<2)?3:(4?5:6))",
+		"1?2=3:4":               "(1?(2=3):4)",
+	}
+
+	for input, want := range tests {
+		out, err := parser.Parse(input)
+		if err != nil {
+			t.Errorf("failed to parse %q: %v", input, err)
+		} else if fmt.Sprint(out) != want {
+			t.Errorf("parsing %q, got %v, want %v", input, out, want)
+		}
+	}
+
+	for _, input := range []string{"1<2<3", "1+", "*1", "(1", "1?2"} {
+		if _, err := parser.Parse(input); err == nil {
+			t.Errorf("%q should not parse", input)
+		}
+	}
+
+	g := BuildGrammar(func(g *G) {
+		g.Start = "op"
+		g.Operators("op", func(op *OpTable) {
+			op.Left(1, "+")
+		})
+	})
+	if g.Err == nil {
+		t.Error("Operators() without an Atom() should fail")
+	}
 }
 
 func TestLogger(t *testing.T) {
@@ -754,6 +1011,27 @@ func TestBinaryMode(t *testing.T) {
 		}
 	}
 
+	// columns count bytes, even when they look like UTF-8
+
+	parser = BuildParser(func(g *G) {
+		g.Mode = BinaryMode()
+		g.Start = "start"
+		g.Define("start").Do(func() {
+			g.Byte()
+			g.Byte()
+			g.ByteString("y")
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	_, err := parser.ParseTree("\xc3\xa9x")
+	var f *ParseFailure
+	if !errors.As(err, &f) || f.Offset != 2 || f.Column != 3 {
+		t.Errorf("wrong binary column: %v", err)
+	}
 }
 
 func TestTextMode(t *testing.T) {
@@ -907,132 +1185,2282 @@ func TestCapture(t *testing.T) {
 	}
 }
 
-func TestBlockIndent(t *testing.T) {
+func TestParseFailure(t *testing.T) {
 	var parser *Parser
-	var ok bool
+	var err error
 
 	parser = BuildParser(func(g *G) {
-		g.Start = "expr"
-		g.Mode = TextMode().Tabstop(8)
-		g.Define("expr").Do(func() {
-			g.Choice(func() {
-				g.String("block:")
-				g.Newline()
-				g.IndentedBlock(func() {
-					g.Repeat().Do(func() {
-						g.Indent()
-						g.Call("expr")
-					})
-				})
-			}, func() {
-				g.String("row")
-				g.Newline()
+		g.Start = "list"
+		g.Define("list").Do(func() {
+			g.String("[")
+			g.WhitespaceNewline()
+			g.Call("item")
+			g.Repeat().Do(func() {
+				g.WhitespaceNewline()
+				g.String(",")
+				g.WhitespaceNewline()
+				g.Call("item")
 			})
+			g.WhitespaceNewline()
+			g.String("]")
+		})
+		g.Define("item").Do(func() {
+			g.Reject(func() {
+				g.String("x")
+			})
+			g.Rune().Range("a-z")
 		})
-
 	})
 
 	if parser.Err() != nil {
-		t.Errorf("error defining grammar:\n%v", parser.Err())
-	} else {
-		ok = parser.testRule("expr",
-			[]string{}, // "block:\n row\n", "block:\n row\n row\n row\n", "block:\n block:\n  row\n"},
-			[]string{
-				"", "block:\nrow\n\n", "\n row",
-				"block:\n row\n row\n  row\n",
-				"block:\nblock:\n  row\n",
-				"block:\nxrow\n",
-			},
-		)
-		if !ok {
-			t.Error("indent test case failed")
-		}
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
 	}
-}
 
-func TestOffsideIndent(t *testing.T) {
-	var parser *Parser
-	var ok bool
+	_, err = parser.ParseTree("[\n  a,\n  b c]")
 
-	parser = BuildParser(func(g *G) {
-		g.Start = "expr"
-		g.Mode = TextMode().Tabstop(8)
-		g.Define("expr").Do(func() {
-			g.Choice(func() {
-				g.Choice(func() {
-					g.String("do")
-				}, func() {
-					g.String("let")
-				})
+	var f *ParseFailure
+	if !errors.Is(err, ParseError) || !errors.As(err, &f) {
+		t.Fatalf("expected a parse failure, got %v", err)
+	}
 
-				g.OffsideBlock(func() {
-					g.Whitespace()
-					g.Newline()
-					g.Repeat().Do(func() {
-						g.Indent()
-						g.Call("expr")
-					})
-				})
-			}, func() {
-				g.String("row")
-				g.Newline()
+	t.Logf("parse failure: %v", err)
+
+	if f.Line != 3 || f.Column != 5 || f.Offset != 11 {
+		t.Errorf("wrong position, got line %v, col %v, offset %v", f.Line, f.Column, f.Offset)
+	}
+	if err.Error() != `line 3, col 5: expected "," or "]" in rule "list"` {
+		t.Errorf("wrong message, got %q", err.Error())
+	}
+
+	if f.Format() != "line 3, col 5: expected \",\" or \"]\" in rule \"list\"\n  b c]\n    ^" {
+		t.Errorf("wrong format, got:\n%v", f.Format())
+	}
+
+	_, err = parser.ParseTree("[\n\ta,\tb c]")
+	if !errors.As(err, &f) {
+		t.Fatalf("expected a parse failure, got %v", err)
+	} else if f.Format() != "line 2, col 19: expected \",\" or \"]\" in rule \"list\"\n        a,      b c]\n                  ^" {
+		t.Errorf("wrong format, got:\n%v", f.Format())
+	}
+
+	_, err = parser.ParseTree("[a,1]")
+	if err == nil {
+		t.Fatal("expected a parse failure")
+	} else if err.Error() != `line 1, col 4: expected [a-z] in rule "item"` {
+		t.Errorf("wrong message, got %q", err.Error())
+	}
+
+	_, err = parser.ParseTree("[a]]")
+	if err == nil {
+		t.Fatal("expected a parse failure")
+	} else if err.Error() != `line 1, col 4: expected end of file` {
+		t.Errorf("wrong message, got %q", err.Error())
+	}
+
+	// columns count runes, like the caret
+
+	parser = BuildParser(func(g *G) {
+		g.Start = "shout"
+		g.Define("shout").Do(func() {
+			g.Repeat().Do(func() {
+				g.Rune().Except("!")
 			})
+			g.String("!")
+			g.String("?")
 		})
-
 	})
 
 	if parser.Err() != nil {
-		t.Errorf("error defining grammar:\n%v", parser.Err())
-	} else {
-		ok = parser.testRule("expr",
-			[]string{"row\n", "do\n  row\n", "let\n   row\n   row\n   row\n", "do\n  let\n     row\n"},
-			[]string{"", "do\nrow\n", "do\nxxrow\n", "\nrow", "do\n  let\n    row\n"},
-		)
-		if !ok {
-			t.Error("indent test case failed")
-		}
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	_, err = parser.ParseTree("héllo\twörld!x")
+	if !errors.As(err, &f) {
+		t.Fatalf("expected a parse failure, got %v", err)
+	} else if f.Column != 15 || f.Offset != 14 {
+		t.Errorf("wrong position, got col %v, offset %v", f.Column, f.Offset)
+	} else if f.Format() != "line 1, col 15: expected \"?\" in rule \"shout\"\nhéllo   wörld!x\n              ^" {
+		t.Errorf("wrong format, got:\n%v", f.Format())
 	}
 }
 
-func TestTabStop(t *testing.T) {
+func TestMemo(t *testing.T) {
 	var parser *Parser
 	var ok bool
 
+	// without memoization, each level of brackets triples the work
+
 	parser = BuildParser(func(g *G) {
 		g.Start = "expr"
-		g.Mode = TextMode().Tabstop(8)
-		g.Define("expr").Do(func() {
-			g.Whitespace().Width(4)
-			g.Whitespace().Width(5)
-			g.String("hello")
+		g.Memo = true
+
+		g.Define("expr").Choice(func() {
+			g.Call("term")
+			g.String("+")
+			g.Call("expr")
+		}, func() {
+			g.Call("term")
+			g.String("-")
+			g.Call("expr")
+		}, func() {
+			g.Call("term")
 		})
 
+		g.Define("term").Choice(func() {
+			g.String("(")
+			g.Call("expr")
+			g.String(")")
+		}, func() {
+			g.Rune().Range("0-9")
+		})
 	})
 
 	if parser.Err() != nil {
-		t.Errorf("error defining grammar:\n%v", parser.Err())
-	} else {
-		ok = parser.testRule("expr",
-			[]string{
-				"\t hello",
-				" \t hello",
-				"  \t hello",
-				"   \t hello",
-				"    \t hello",
-				"     \t hello",
-				"      \t hello",
-				"       \t hello",
-				"         hello",
-			},
-			[]string{
-				" hello",
-				"\thello",
-				"        \thello",
-			},
-		)
-		if !ok {
-			t.Error("tab test case failed")
-		}
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	deep := strings.Repeat("(", 40) + "1" + strings.Repeat(")", 40)
+
+	ok = parser.testGrammar(
+		[]string{"1", "1+2", "(1-2)+3", deep, deep + "+" + deep},
+		[]string{"", "(", "1+", deep + ")"},
+	)
+	if !ok {
+		t.Error("memo test case failed")
+	}
+
+	// count how often the term rule runs, with and without memo
+
+	calls := 0
+	countStub := func(memo bool) func(*G) {
+		return func(g *G) {
+			g.Start = "expr"
+			g.Memo = memo
+
+			g.Define("expr").Choice(func() {
+				g.Call("term")
+				g.String("+")
+				g.Call("expr")
+			}, func() {
+				g.Call("term")
+				g.String("-")
+				g.Call("expr")
+			}, func() {
+				g.Call("term")
+			})
+
+			g.Define("term").Do(func() {
+				g.Predicate(func(m *MatchContext) bool {
+					calls++
+					return true
+				})
+				g.Choice(func() {
+					g.String("(")
+					g.Call("expr")
+					g.String(")")
+				}, func() {
+					g.Rune().Range("0-9")
+				})
+			})
+		}
+	}
+
+	nested := strings.Repeat("(", 8) + "1" + strings.Repeat(")", 8)
+	counts := []int{}
+	for _, memo := range []bool{true, false} {
+		parser = BuildParser(countStub(memo))
+		if parser.Err() != nil {
+			t.Fatalf("error defining grammar:\n%v", parser.Err())
+		}
+		calls = 0
+		if _, err := parser.ParseTree(nested); err != nil {
+			t.Errorf("failed to parse %q: %v", nested, err)
+		}
+		counts = append(counts, calls)
+	}
+	// once for each bracket and the digit, and 3^9 times without
+	if counts[0] != 9 || counts[1] < 3*3*3*3*3*3*3*3*3 {
+		t.Errorf("wrong number of calls, with memo: %v, without: %v", counts[0], counts[1])
+	}
+
+	// memoized nodes get moved around the tree when replayed
+
+	stub := func(memo bool) func(*G) {
+		return func(g *G) {
+			g.Start = "start"
+			g.Define("start").Choice(func() {
+				g.String("<")
+				g.Call("item")
+				g.String("!")
+			}, func() {
+				g.Capture("prefix", func() {
+					g.String("<")
+				})
+				g.Call("item")
+				g.String("?")
+			}, func() {
+				g.Capture("prefix", func() {
+					g.String("<")
+				})
+				g.Capture("prefix", func() {
+					g.Call("item")
+				})
+				g.String(".")
+			})
+
+			item := g.Define("item")
+			if memo {
+				item = item.Memo()
+			}
+			item.Do(func() {
+				g.Capture("item", func() {
+					g.Capture("n", func() {
+						g.Rune().Range("0-9")
+					})
+					g.Capture("n", func() {
+						g.Rune().Range("0-9")
+					})
+				})
+			})
+		}
+	}
+
+	memoParser := BuildParser(stub(true))
+	if memoParser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", memoParser.Err())
+	}
+	plainParser := BuildParser(stub(false))
+	if plainParser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", plainParser.Err())
+	}
+
+	dump := func(tree *ParseTree) string {
+		var out []string
+		tree.Walk(func(n *Node) {
+			out = append(out, fmt.Sprintf("%v %q %v", n.name, tree.buf[n.start:n.end], n.nsibling))
+		})
+		return strings.Join(out, ", ")
+	}
+
+	for _, input := range []string{"<12!", "<12?", "<12."} {
+		tree, err := memoParser.ParseTree(input)
+		if err != nil {
+			t.Errorf("memo parse of %q failed: %v", input, err)
+			continue
+		}
+		expected, err := plainParser.ParseTree(input)
+		if err != nil {
+			t.Errorf("parse of %q failed: %v", input, err)
+			continue
+		}
+
+		if dump(tree) != dump(expected) {
+			t.Errorf("memo tree differs for %q:\n%v\n%v", input, dump(tree), dump(expected))
+		}
+	}
+
+	// a memoized failure reports what it expected, even when the
+	// first call was inside a Reject()
+
+	errStub := func(memo bool) func(*G) {
+		return func(g *G) {
+			g.Start = "start"
+			g.Define("start").Do(func() {
+				g.Capture("start", func() {
+					g.Reject(func() {
+						g.Call("item")
+						g.String("!")
+					})
+					g.Call("item")
+					g.String(";")
+				})
+			})
+
+			item := g.Define("item")
+			if memo {
+				item = item.Memo()
+			}
+			item.Do(func() {
+				g.String("a")
+				g.Rune().Range("0-9")
+			})
+		}
+	}
+
+	memoParser = BuildParser(errStub(true))
+	plainParser = BuildParser(errStub(false))
+
+	for _, input := range []string{"ab", "a", "a1", "a1!"} {
+		_, memoErr := memoParser.ParseTree(input)
+		_, plainErr := plainParser.ParseTree(input)
+		if memoErr == nil || plainErr == nil {
+			t.Errorf("parse of %q should fail", input)
+		} else if memoErr.Error() != plainErr.Error() {
+			t.Errorf("memo error differs for %q:\n%v\n%v", input, memoErr, plainErr)
+		}
+	}
+
+	// blocks with the same indentation share memoized results
+
+	calls = 0
+	parser = BuildParser(func(g *G) {
+		g.Start = "block"
+		g.Mode = TextMode()
+		g.Define("block").Choice(func() {
+			g.String("do")
+			g.OffsideBlock(func() {
+				g.Newline()
+				g.Indent()
+				g.Call("item")
+				g.String("!")
+			})
+		}, func() {
+			g.String("do")
+			g.OffsideBlock(func() {
+				g.Newline()
+				g.Indent()
+				g.Call("item")
+				g.String("?")
+			})
+		})
+		g.Define("item").Memo().Do(func() {
+			g.Predicate(func(m *MatchContext) bool {
+				calls++
+				return true
+			})
+			g.String("x")
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+	if !parser.testGrammar([]string{"do\n  x?"}, []string{"do\nx?"}) {
+		t.Error("memo block test case failed")
+	}
+	if calls != 1 {
+		t.Errorf("memoized rule called %v times, not once", calls)
+	}
+
+	// left recursive rules can't be memoized
+
+	g := BuildGrammar(func(g *G) {
+		g.Start = "expr"
+		g.Define("expr").Memo().Recursive("expr").Choice(func() {
+			g.Call("expr")
+			g.String("+")
+		}, func() {
+			g.String("1")
+		})
+	})
+
+	if g.Err == nil {
+		t.Error("memoized left recursion should raise error")
+	} else {
+		t.Logf("test grammar raised error:\n %v", g.Err)
+	}
+}
+
+func TestBackref(t *testing.T) {
+	var parser *Parser
+	var ok bool
+
+	parser = BuildParser(func(g *G) {
+		g.Mode = StringMode()
+		g.Start = "start"
+
+		g.Define("start").Do(func() {
+			g.Call("raw_string")
+			g.Call("fence")
+			g.Call("rebind")
+		})
+
+		g.Define("raw_string").Do(func() {
+			g.String("r")
+			g.Bind("hashes", func() {
+				g.Repeat().Do(func() {
+					g.String("#")
+				})
+			})
+			g.String("\"")
+			g.Capture("raw_string", func() {
+				g.Repeat().Do(func() {
+					g.Reject(func() {
+						g.String("\"")
+						g.Backref("hashes")
+					})
+					g.Rune()
+				})
+			})
+			g.String("\"")
+			g.Backref("hashes")
+		})
+
+		g.Define("fence").Do(func() {
+			g.Bind("fence", func() {
+				g.Repeat().Min(3).Do(func() {
+					g.String("`")
+				})
+			})
+			g.Newline()
+			g.Repeat().Do(func() {
+				g.Reject(func() {
+					g.Backref("fence")
+					g.EndOfLine()
+				})
+				g.Repeat().Do(func() {
+					g.Rune().Except("\n")
+				})
+				g.Newline()
+			})
+			g.Backref("fence")
+			g.EndOfLine()
+		})
+
+		g.Define("rebind").Do(func() {
+			g.Choice(func() {
+				g.Bind("d", func() {
+					g.String("a")
+				})
+				g.String("!")
+			}, func() {
+				g.String("ab")
+			})
+			g.String("-")
+			g.Backref("d")
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	ok = parser.testRule("raw_string",
+		[]string{`r""`, `r"abc"`, `r#"a"b"#`, `r##"a"#b"##`},
+		[]string{`r#"abc"`, `r##"a"#`, `r#"a"##`},
+	)
+	if !ok {
+		t.Error("raw string test case failed")
+	}
+
+	ok = parser.testRule("fence",
+		[]string{"```\ncode\n```", "````\n```\n````\n"},
+		[]string{"```\ncode\n````", "````\ncode\n```\n"},
+	)
+	if !ok {
+		t.Error("fence test case failed")
+	}
+
+	// the binding is thrown away when the choice backtracks
+
+	ok = parser.testRule("rebind",
+		[]string{"a!-a"},
+		[]string{"ab-a", "ab-ab", "ab-"},
+	)
+	if !ok {
+		t.Error("rebind test case failed")
+	}
+
+	// bindings are local to a rule
+
+	g := BuildGrammar(func(g *G) {
+		g.Start = "outer"
+		g.Define("outer").Do(func() {
+			g.Call("inner")
+			g.Backref("d")
+		})
+		g.Define("inner").Do(func() {
+			g.Bind("d", func() {
+				g.String("a")
+			})
+		})
+	})
+
+	if g.Err == nil {
+		t.Error("backref outside rule should raise error")
+	} else {
+		t.Logf("test grammar raised error:\n %v", g.Err)
+	}
+}
+
+func TestCount(t *testing.T) {
+	var parser *Parser
+	var ok bool
+
+	parser = BuildParser(func(g *G) {
+		g.Mode = StringMode()
+		g.Start = "start"
+
+		g.Define("start").Do(func() {
+			g.Call("netstring")
+			g.Call("chunk")
+			g.Call("letters")
+		})
+
+		g.Define("netstring").Do(func() {
+			g.Count("length")
+			g.String(":")
+			g.Capture("netstring", func() {
+				g.Take("length")
+			})
+			g.String(",")
+		})
+
+		g.Define("chunk").Do(func() {
+			g.Count("size").Hex()
+			g.String("\r\n")
+			g.Take("size")
+			g.String("\r\n")
+		})
+
+		g.Define("letters").Do(func() {
+			g.Count("n")
+			g.String(":")
+			g.Repeat().Count("n").Do(func() {
+				g.Rune().Range("a-z")
+			})
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	ok = parser.testRule("netstring",
+		[]string{"0:,", "5:hello,", "12:hello world!,"},
+		[]string{"", ":,", "5:hell,", "5:hello!,", "99999999999999999999999:,"},
+	)
+	if !ok {
+		t.Error("netstring test case failed")
+	}
+
+	ok = parser.testRule("chunk",
+		[]string{"0\r\n\r\n", "a\r\n0123456789\r\n", "A\r\n0123456789\r\n"},
+		[]string{"a\r\n012345678\r\n", "g\r\n\r\n"},
+	)
+	if !ok {
+		t.Error("chunk test case failed")
+	}
+
+	ok = parser.testRule("letters",
+		[]string{"0:", "3:abc"},
+		[]string{"3:ab", "3:abcd", "2:a1"},
+	)
+	if !ok {
+		t.Error("repeat count test case failed")
+	}
+
+	parser = BuildParser(func(g *G) {
+		g.Mode = BinaryMode()
+		g.Start = "start"
+
+		g.Define("start").Do(func() {
+			g.Call("tlv")
+			g.Call("little")
+		})
+
+		g.Define("tlv").Do(func() {
+			g.Byte()
+			g.Count("length").BigEndian(2)
+			g.Take("length")
+		})
+
+		g.Define("little").Do(func() {
+			g.Count("length").LittleEndian(4)
+			g.Take("length")
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	ok = parser.testRule("tlv",
+		[]string{"\x01\x00\x00", "\x01\x00\x03abc", "\x01\x01\x00" + strings.Repeat("x", 256)},
+		[]string{"\x01\x00", "\x01\x00\x03ab", "\x01\x00\x03abcd"},
+	)
+	if !ok {
+		t.Error("big endian test case failed")
+	}
+
+	ok = parser.testRule("little",
+		[]string{"\x00\x00\x00\x00", "\x03\x00\x00\x00abc"},
+		[]string{"\x00\x00\x00\x03abc"},
+	)
+	if !ok {
+		t.Error("little endian test case failed")
+	}
+
+	// runes, not bytes, in text mode
+
+	parser = BuildParser(func(g *G) {
+		g.Define("text").Do(func() {
+			g.Count("length")
+			g.String(":")
+			g.Take("length")
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	ok = parser.testRule("text",
+		[]string{"2:\u00e9\u00e9", "1:\n"},
+		[]string{"4:\u00e9\u00e9"},
+	)
+	if !ok {
+		t.Error("text mode count test case failed")
+	}
+
+	g := BuildGrammar(func(g *G) {
+		g.Define("text").Do(func() {
+			g.Count("length").BigEndian(2)
+			g.Take("missing")
+		})
+	})
+
+	if g.Err == nil {
+		t.Error("missing count and bad mode should raise error")
+	} else {
+		t.Logf("test grammar raised error:\n %v", g.Err)
+	}
+}
+
+type testPair struct {
+	key   string
+	value int
+}
+
+func TestTypedBuilder(t *testing.T) {
+	grammar := func(pair any, value any) func(*G) {
+		return func(g *G) {
+			g.Start = "pairs"
+			g.Define("pairs").Do(func() {
+				g.Capture("pairs", func() {
+					g.Repeat().Min(1).Do(func() {
+						g.Call("pair")
+					})
+				})
+			})
+			g.Define("pair").Do(func() {
+				g.Capture("pair", func() {
+					g.Capture("key", func() {
+						g.Rune().Range("a-z")
+					})
+					g.String("=")
+					g.Capture("value", func() {
+						g.Rune().Range("0-9")
+					})
+				})
+				g.String(";")
+			})
+			g.Builder("pairs", func(s string, pairs ...testPair) ([]testPair, error) {
+				return pairs, nil
+			})
+			g.Builder("pair", pair)
+			g.Builder("key", func(s string) (*string, error) {
+				return &s, nil
+			})
+			g.Builder("value", value)
+		}
+	}
+
+	intValue := func(s string) (int, error) {
+		return int(s[0] - '0'), nil
+	}
+
+	parser := BuildParser(grammar(func(s string, key *string, value int) (testPair, error) {
+		return testPair{*key, value}, nil
+	}, intValue))
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	out, err := parser.Parse("a=1;b=2;")
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	if fmt.Sprint(out) != "[{a 1} {b 2}]" {
+		t.Errorf("wrong output: %v", out)
+	}
+
+	// builders get checked against their captures
+
+	g := BuildGrammar(grammar(func(s string, key *string) (testPair, error) {
+		return testPair{}, nil
+	}, intValue))
+	if g.Err == nil {
+		t.Error("builder with too few arguments should raise error")
+	} else {
+		t.Logf("test grammar raised error:\n %v", g.Err)
+	}
+
+	g = BuildGrammar(grammar(func(s string, key *string, value string) (testPair, error) {
+		return testPair{}, nil
+	}, intValue))
+	if g.Err == nil {
+		t.Error("builder with wrong argument type should raise error")
+	} else {
+		t.Logf("test grammar raised error:\n %v", g.Err)
+	}
+
+	g = BuildGrammar(grammar(func(key *string, value int) testPair {
+		return testPair{}
+	}, intValue))
+	if g.Err == nil {
+		t.Error("builder with wrong signature should raise error")
+	} else {
+		t.Logf("test grammar raised error:\n %v", g.Err)
+	}
+
+	// untyped builders get checked when they're called
+
+	parser = BuildParser(grammar(func(s string, key *string, value int) (testPair, error) {
+		return testPair{*key, value}, nil
+	}, BuilderOf(func(s string, args []any) (string, error) {
+		return s, nil
+	})))
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	_, err = parser.Parse("a=1;")
+	if err == nil {
+		t.Error("builder with wrong argument type should fail")
+	} else {
+		t.Logf("build raised error: %v", err)
+	}
+}
+
+type testDecodeItem struct {
+	Key   string `ez:"key"`
+	Value int    `ez:"value"`
+}
+
+type testDecodeDoc struct {
+	Name  string           `ez:"name"`
+	Items []testDecodeItem `ez:"item"`
+	Note  *string          `ez:"note"`
+	Text  string           `ez:",text"`
+}
+
+func TestBuildContext(t *testing.T) {
+	parser := BuildParser(func(g *G) {
+		g.Start = "list"
+		g.Define("list").Do(func() {
+			g.Capture("list", func() {
+				g.Call("item")
+				g.Repeat().Do(func() {
+					g.String(",")
+					g.WhitespaceNewline()
+					g.Call("item")
+				})
+			})
+		})
+		g.Define("item").Do(func() {
+			g.Capture("item", func() {
+				g.Rune().Range("a-z")
+			})
+		})
+		g.Builder("list", func(ctx *BuildContext, items ...string) ([]string, error) {
+			if len(ctx.Children()) != len(items) || ctx.Name() != "list" {
+				return nil, errors.New("wrong children")
+			}
+			return items, nil
+		})
+		g.Builder("item", func(ctx *BuildContext, args []any) (any, error) {
+			seen := ctx.State.(map[string]int)
+			seen[ctx.Text()]++
+			start, _ := ctx.Span()
+			return fmt.Sprintf("%v@%v:%v:%v", ctx.Text(), start, ctx.Line(), ctx.Column()), nil
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	seen := map[string]int{}
+	out, err := parser.ParseWith("a,\n  b,a", seen)
+	if err != nil {
+		t.Fatalf("failed to build: %v", err)
+	}
+	if fmt.Sprint(out) != "[a@0:1:1 b@5:2:3 a@7:2:5]" {
+		t.Errorf("wrong output: %v", out)
+	}
+	if seen["a"] != 2 || seen["b"] != 1 {
+		t.Errorf("wrong state: %v", seen)
+	}
+
+	seen = map[string]int{}
+	out, err = parser.ParseRuleWith("item", "b", seen)
+	if err != nil || fmt.Sprint(out) != "b@0:1:1" || seen["b"] != 1 {
+		t.Errorf("wrong rule output: %v, %v, %v", out, err, seen)
+	}
+
+	seen = map[string]int{}
+	out, err = parser.ParseReaderWith(strings.NewReader("a,b"), seen)
+	if err != nil || fmt.Sprint(out) != "[a@0:1:1 b@2:1:3]" || seen["a"] != 1 || seen["b"] != 1 {
+		t.Errorf("wrong reader output: %v, %v, %v", out, err, seen)
+	}
+}
+
+func TestBuildError(t *testing.T) {
+	bad := errors.New("bad item")
+	parser := BuildParser(func(g *G) {
+		g.Start = "list"
+		g.Define("list").Do(func() {
+			g.Capture("list", func() {
+				g.Call("item")
+				g.Repeat().Do(func() {
+					g.String(",")
+					g.WhitespaceNewline()
+					g.Call("item")
+				})
+			})
+		})
+		g.Define("item").Do(func() {
+			g.Capture("item", func() {
+				g.Rune().Range("a-z")
+			})
+		})
+		g.Builder("list", func(s string, args []any) (any, error) {
+			return args, nil
+		})
+		g.Builder("item", func(s string, args []any) (any, error) {
+			if s == "x" {
+				return nil, bad
+			}
+			return s, nil
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	_, err := parser.Parse("a,\n  x")
+	var e *BuildError
+	if !errors.As(err, &e) || !errors.Is(err, bad) {
+		t.Fatalf("wrong error for bad item: %v", err)
+	}
+	if e.Capture != "item" || e.Start != 5 || e.Line != 2 || e.Column != 3 || fmt.Sprint(e.Parents) != "[list]" {
+		t.Errorf("wrong location for bad item: %+v", e)
+	}
+	t.Logf("build error: %v", e)
+
+	tree, err := parser.ParseTree("a,b")
+	if err != nil {
+		t.Fatalf("failed to parse:\n%v", err)
+	}
+	_, err = tree.Build(map[string]any{})
+	if !errors.As(err, &e) || e.Capture != "item" || e.Column != 1 {
+		t.Errorf("wrong error for missing builder: %v", err)
+	}
+}
+
+func TestDecode(t *testing.T) {
+	parser := BuildParser(func(g *G) {
+		g.Start = "doc"
+		g.Define("doc").Do(func() {
+			g.Capture("doc", func() {
+				g.Capture("name", func() {
+					g.Call("word")
+				})
+				g.String(":")
+				g.Repeat().Do(func() {
+					g.String(" ")
+					g.Capture("item", func() {
+						g.Capture("key", func() {
+							g.Call("word")
+						})
+						g.String("=")
+						g.Capture("value", func() {
+							g.Repeat().Min(1).Do(func() {
+								g.Rune().Range("0-9")
+							})
+						})
+					})
+				})
+				g.Optional().Do(func() {
+					g.String(" #")
+					g.Capture("note", func() {
+						g.Call("word")
+					})
+				})
+			})
+		})
+		g.Define("word").Do(func() {
+			g.Repeat().Min(1).Do(func() {
+				g.Rune().Range("a-z")
+			})
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	tree, err := parser.ParseTree("doc: a=1 b=22")
+	if err != nil {
+		t.Fatalf("failed to parse:\n%v", err)
+	}
+
+	var doc testDecodeDoc
+	if err := tree.Decode(&doc); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if fmt.Sprint(doc) != "{doc [{a 1} {b 22}] <nil> doc: a=1 b=22}" {
+		t.Errorf("wrong decode: %v", doc)
+	}
+
+	tree, err = parser.ParseTree("doc: #note")
+	if err != nil {
+		t.Fatalf("failed to parse:\n%v", err)
+	}
+
+	doc = testDecodeDoc{}
+	if err := tree.Decode(&doc); err != nil {
+		t.Fatalf("failed to decode: %v", err)
+	}
+	if doc.Note == nil || *doc.Note != "note" || len(doc.Items) != 0 {
+		t.Errorf("wrong decode: %v", doc)
+	}
+
+	var wrong struct {
+		Name int `ez:"name"`
+	}
+	if err := tree.Decode(&wrong); err == nil {
+		t.Error("decoding a word into an int should fail")
+	}
+	if err := tree.Decode(doc); err == nil {
+		t.Error("decoding into a non-pointer should fail")
+	}
+}
+
+func TestParseTree(t *testing.T) {
+	parser := BuildParser(func(g *G) {
+		g.Start = "list"
+		g.Define("list").Do(func() {
+			g.Capture("list", func() {
+				g.String("[")
+				g.Call("item")
+				g.Repeat().Do(func() {
+					g.String(",")
+					g.WhitespaceNewline()
+					g.Call("item")
+				})
+				g.String("]")
+			})
+		})
+		g.Define("item").Do(func() {
+			g.Capture("item", func() {
+				g.Rune().Range("a-z")
+			})
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	tree, err := parser.ParseTree("[a,\n  b]")
+	if err != nil {
+		t.Fatalf("failed to parse:\n%v", err)
+	}
+
+	root := tree.Root()
+	if root.Name() != "list" || tree.Parent(root) != nil || root.Text(tree) != "[a,\n  b]" {
+		t.Errorf("bad root node %v", root)
+	}
+
+	children := tree.Children(root)
+	if len(children) != 2 {
+		t.Fatalf("wrong children %v", children)
+	}
+
+	b := children[1]
+	start, end := b.Span()
+	if b.Name() != "item" || b.Text(tree) != "b" || start != 6 || end != 7 {
+		t.Errorf("bad child node %v", b)
+	}
+	if b.Line() != 2 || b.Column() != 3 {
+		t.Errorf("bad child position %v:%v", b.Line(), b.Column())
+	}
+	if tree.Parent(b) != root || len(tree.Children(b)) != 0 {
+		t.Errorf("bad child links for %v", b)
+	}
+}
+
+type testVisitor struct {
+	tree  *ParseTree
+	skip  string
+	trace []string
+}
+
+func (v *testVisitor) Enter(n *Node, depth int) bool {
+	v.trace = append(v.trace, fmt.Sprintf("%v+%v", depth, n.Text(v.tree)))
+	return n.Name() == v.skip
+}
+
+func (v *testVisitor) Exit(n *Node, depth int) {
+	v.trace = append(v.trace, fmt.Sprintf("%v-%v", depth, n.Text(v.tree)))
+}
+
+func TestVisit(t *testing.T) {
+	parser := BuildParser(func(g *G) {
+		g.Start = "expr"
+		g.Define("expr").Do(func() {
+			g.Choice(func() {
+				g.Capture("group", func() {
+					g.String("(")
+					g.Repeat().Do(func() {
+						g.Call("expr")
+					})
+					g.String(")")
+				})
+			}, func() {
+				g.Capture("atom", func() {
+					g.Rune().Range("a-z")
+				})
+			})
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	tree, err := parser.ParseTree("(a(b))")
+	if err != nil {
+		t.Fatalf("failed to parse:\n%v", err)
+	}
+
+	v := &testVisitor{tree: tree}
+	tree.Visit(v)
+	expected := "[0+(a(b)) 1+a 1-a 1+(b) 2+b 2-b 1-(b) 0-(a(b))]"
+	if fmt.Sprint(v.trace) != expected {
+		t.Errorf("wrong visit order: %v", v.trace)
+	}
+
+	v = &testVisitor{tree: tree, skip: "group"}
+	tree.Visit(v)
+	if fmt.Sprint(v.trace) != "[0+(a(b)) 0-(a(b))]" {
+		t.Errorf("wrong visit order when skipping: %v", v.trace)
+	}
+}
+
+func TestParsePrefix(t *testing.T) {
+	parser := BuildParser(func(g *G) {
+		g.Mode = StringMode()
+		g.Start = "list"
+		g.Define("list").Do(func() {
+			g.String("[")
+			g.Capture("item", func() {
+				g.Repeat().Do(func() {
+					g.Rune().Range("a-z")
+				})
+			})
+			g.String("]")
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	tree, n, err := parser.ParsePrefix("[abc] trailing")
+	if err != nil || n != 5 {
+		t.Fatalf("prefix parse gave %v, %v", n, err)
+	}
+	if text := tree.text(&tree.nodes[tree.root]); text != "abc" {
+		t.Errorf("prefix parse captured %q", text)
+	}
+
+	_, n, err = parser.ParsePrefix("[abc")
+	if !errors.Is(err, ParseError) || n != 0 {
+		t.Errorf("bad prefix gave %v, %v", n, err)
+	}
+}
+
+func TestParseRule(t *testing.T) {
+	parser := BuildParser(func(g *G) {
+		g.Start = "pair"
+		g.Define("pair").Do(func() {
+			g.Capture("pair", func() {
+				g.Call("word")
+				g.String("=")
+				g.Call("word")
+			})
+		})
+		g.Define("word").Do(func() {
+			g.Capture("word", func() {
+				g.Repeat().Min(1).Do(func() {
+					g.Rune().Range("a-z")
+				})
+			})
+		})
+		g.Builder("pair", func(s string, args []any) (any, error) {
+			return fmt.Sprintln(args...), nil
+		})
+		g.Builder("word", func(s string, args []any) (any, error) {
+			return s, nil
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	out, err := parser.ParseRule("word", "abc")
+	if err != nil || out != "abc" {
+		t.Errorf("word rule gave %q, %v", out, err)
+	}
+
+	out, err = parser.ParseRule("pair", "a=b")
+	if err != nil || out != "a b\n" {
+		t.Errorf("pair rule gave %q, %v", out, err)
+	}
+
+	_, err = parser.ParseRule("word", "a=b")
+	if !errors.Is(err, ParseError) {
+		t.Errorf("word rule should reject pair, got %v", err)
+	}
+
+	_, err = parser.ParseTreeRule("missing", "abc")
+	if err == nil || errors.Is(err, ParseError) {
+		t.Errorf("missing rule gave %v", err)
+	}
+}
+
+func TestPredicate(t *testing.T) {
+	parser := BuildParser(func(g *G) {
+		g.Start = "expr"
+		g.Define("expr").Do(func() {
+			g.Choice(func() {
+				g.Call("ident")
+			}, func() {
+				g.Call("byte")
+			})
+		})
+		g.Define("ident").Do(func() {
+			g.Capture("ident", func() {
+				g.Repeat().Min(1).Do(func() {
+					g.Rune().Range("a-z")
+				})
+				g.Predicate(func(m *MatchContext) bool {
+					return m.Text() != "if" && m.Text() != "else"
+				})
+			})
+		})
+		g.Define("byte").Do(func() {
+			g.Capture("byte", func() {
+				g.Repeat().Min(1).Do(func() {
+					g.Rune().Range("0-9")
+				})
+			})
+			g.Predicate(func(m *MatchContext) bool {
+				// outside the capture, so the text starts at the beginning
+				n, err := strconv.Atoi(m.Text())
+				return err == nil && n < 256 && m.Offset() == len(m.Text()) && m.Column() == m.Offset()+1
+			})
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	ok := parser.testGrammar(
+		[]string{"x", "iff", "elsewhere", "0", "255"},
+		[]string{"if", "else", "256", "1000"},
+	)
+	if !ok {
+		t.Error("predicate test case failed")
+	}
+
+	// memoized rules that call a predicate depend on the capture, but
+	// other memoized rules don't
+
+	memo := BuildGrammar(func(g *G) {
+		g.Start = "start"
+		g.Memo = true
+		g.Define("start").Choice(func() {
+			g.String("x")
+			g.Capture("a", func() {
+				g.Call("check")
+				g.String("!")
+			})
+		}, func() {
+			g.Capture("b", func() {
+				g.String("x")
+				g.Call("check")
+			})
+		})
+		g.Define("check").Do(func() {
+			g.Call("word")
+			g.Predicate(func(m *MatchContext) bool {
+				return m.Text() == "xy"
+			})
+		})
+		g.Define("word").Do(func() {
+			g.Rune().Range("a-z")
+		})
+	})
+
+	if memo.Err != nil {
+		t.Fatalf("error defining grammar:\n%v", memo.Err)
+	}
+	if !memo.rules["start"].predicates || !memo.rules["check"].predicates || memo.rules["word"].predicates {
+		t.Error("wrong rules marked as calling a predicate")
+	}
+	if !memo.Parser().testGrammar([]string{"xy"}, []string{"xz", "xy!"}) {
+		t.Error("memo predicate test case failed")
+	}
+
+	g := BuildGrammar(func(g *G) {
+		g.Define("expr").Do(func() {
+			g.Predicate(nil)
+		})
+	})
+
+	if g.Err == nil {
+		t.Error("nil predicate should raise error")
+	} else {
+		t.Logf("test grammar raised error:\n %v", g.Err)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	digits := func(input string, offset int) (int, bool) {
+		n := 0
+		for offset+n < len(input) && input[offset+n] >= '0' && input[offset+n] <= '9' {
+			n++
+		}
+		return n, true
+	}
+	lines := func(input string, offset int) (int, bool) {
+		n := strings.Index(input[offset:], "end")
+		return n, n >= 0
+	}
+
+	parser := BuildParser(func(g *G) {
+		g.Start = "expr"
+		g.Define("expr").Do(func() {
+			g.Match("text", lines)
+			g.String("end")
+			g.Capture("number", func() {
+				g.Match("digits", digits)
+			})
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	ok := parser.testGrammar(
+		[]string{"a\nbend1", "xend123"},
+		[]string{"end1", "xend", "xendx", "x"},
+	)
+	if !ok {
+		t.Error("match test case failed")
+	}
+
+	tree, err := parser.ParseTree("a\n\tbend1")
+	if err != nil {
+		t.Fatalf("failed to parse:\n%v", err)
+	}
+	if n := tree.Root(); n.Line() != 2 || n.Column() != 13 {
+		t.Errorf("wrong position for match: %v:%v", n.Line(), n.Column())
+	}
+
+	_, err = parser.ParseTree("a\nbendx")
+	if err == nil || !strings.Contains(err.Error(), "expected digits") {
+		t.Errorf("wrong error for bad match: %v", err)
+	}
+
+	tree, err = parser.ParseTreeReader(iotest.OneByteReader(strings.NewReader("a\nbend12")))
+	if err != nil {
+		t.Fatalf("failed to parse reader:\n%v", err)
+	} else if tree.Root().Text(tree) != "12" {
+		t.Errorf("wrong match from reader: %q", tree.Root().Text(tree))
+	}
+}
+
+func TestTrivia(t *testing.T) {
+	parser := BuildParser(func(g *G) {
+		g.Start = "list"
+		g.Trivia(func() {
+			g.Choice(func() {
+				g.Rune().Whitespace()
+			}, func() {
+				g.String("#")
+				g.Repeat().Do(func() {
+					g.Rune().Except("\n")
+				})
+			})
+		})
+		g.Define("list").Do(func() {
+			g.Capture("list", func() {
+				g.String("[")
+				g.Optional().Do(func() {
+					g.Call("item")
+					g.Repeat().Do(func() {
+						g.String(",")
+						g.Call("item")
+					})
+				})
+				g.String("]")
+			})
+		})
+		g.Define("item").Do(func() {
+			g.Capture("item", func() {
+				g.Choice(func() {
+					g.Lexeme(func() {
+						g.Call("word")
+						g.String(".")
+						g.Call("word")
+					})
+				}, func() {
+					g.Call("word")
+					g.Optional().Do(func() {
+						g.String("=")
+						g.Call("word")
+					})
+				})
+			})
+		})
+		g.Define("word").Token().Do(func() {
+			g.Repeat().Min(1).Do(func() {
+				g.Rune().Range("a-z")
+			})
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	ok := parser.testGrammar(
+		[]string{
+			"[]", " [ a , b = c ] ", "[a.b, c # comment\n, d]\n# end", "[ ab.cd ]",
+			"[a, b] ", "[a, b]\n", "[a, b] # c", "[a, b]\t# c\n\n",
+		},
+		[]string{"[a . b]", "[a b]", "[ab c]", "[a.b c]", "[a,]", "[a] x", "[a] # c\nx"},
+	)
+	if !ok {
+		t.Error("trivia test case failed")
+	}
+
+	input := "[a] # c\n[b]"
+	_, n, err := parser.ParsePrefix(input)
+	if err != nil {
+		t.Fatalf("failed to parse prefix: %v", err)
+	}
+	if n != len("[a] # c\n") {
+		t.Errorf("wrong prefix length: %v", n)
+	}
+
+	count := 0
+	err = parser.ParseEach(strings.NewReader("[a] [b, c]\n# end\n"), "list", func(tree *ParseTree) error {
+		count++
+		return nil
+	})
+	if err != nil || count != 2 {
+		t.Errorf("wrong records: %v, %v", count, err)
+	}
+
+	tree, err := parser.ParseTree("[ a  =  b ,\tc ]")
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	items := []string{}
+	tree.Walk(func(n *Node) {
+		if n.Name() == "item" {
+			items = append(items, n.Text(tree))
+		}
+	})
+	if fmt.Sprint(items) != "[a  =  b c]" {
+		t.Errorf("wrong items: %q", items)
+	}
+
+	parser = BuildParser(func(g *G) {
+		g.Start = "pair"
+		g.Trivia(func() {
+			g.Rune().Whitespace()
+		})
+		g.Define("pair").Do(func() {
+			g.String("a")
+			g.Rune().Whitespace()
+			g.String("b")
+			g.Newline()
+			g.String("c")
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	ok = parser.testGrammar(
+		[]string{"a b\nc", " a  b\n c ", "a\tb\n\nc"},
+		[]string{"ab\nc", "a bc"},
+	)
+	if !ok {
+		t.Error("whitespace terminals shouldn't skip trivia")
+	}
+}
+
+func TestTokenMode(t *testing.T) {
+	lexer := BuildLexer(func(g *G) {
+		g.Trivia(func() {
+			g.Choice(func() {
+				g.Rune().Whitespace()
+			}, func() {
+				g.String("//")
+				g.Repeat().Do(func() {
+					g.Rune().Except("\n")
+				})
+			})
+		})
+		g.Define("IF").Token().Do(func() {
+			g.String("if")
+		})
+		g.Define("IDENT").Token().Do(func() {
+			g.Rune().IdentStart()
+			g.Repeat().Do(func() {
+				g.Rune().IdentContinue()
+			})
+		})
+		g.Define("NUMBER").Token().Do(func() {
+			g.Repeat().Min(1).Do(func() {
+				g.Rune().Range("0-9")
+			})
+		})
+		for _, p := range []string{"=", ";", "(", ")"} {
+			p := p
+			g.Define(p).Token().Do(func() {
+				g.String(p)
+			})
+		}
+	})
+
+	if lexer.Err() != nil {
+		t.Fatalf("error defining lexer:\n%v", lexer.Err())
+	}
+
+	tokens, err := lexer.Lex("if x = 12; // comment\n iffy")
+	if err != nil {
+		t.Fatalf("failed to lex: %v", err)
+	}
+	kinds := []string{}
+	for _, tok := range tokens {
+		kinds = append(kinds, tok.Kind)
+	}
+	if fmt.Sprint(kinds) != "[IF IDENT = NUMBER ; IDENT]" {
+		t.Errorf("wrong tokens: %v", kinds)
+	}
+	if last := tokens[len(tokens)-1]; last.Start != 23 || last.End != 27 || last.Line != 2 || last.Column != 2 {
+		t.Errorf("wrong position: %+v", last)
+	}
+	if _, err := lexer.Lex("x = @"); err == nil {
+		t.Error("lexing @ should fail")
+	}
+
+	parser := BuildParser(func(g *G) {
+		g.Mode = TokenMode(lexer)
+		g.Start = "program"
+		g.Define("program").Do(func() {
+			g.Repeat().Min(1).Do(func() {
+				g.Call("stmt")
+			})
+		})
+		g.Define("stmt").Choice(func() {
+			g.Capture("if", func() {
+				g.Token("IF")
+				g.Token("(")
+				g.Call("expr")
+				g.Token(")")
+				g.Call("stmt")
+			})
+		}, func() {
+			g.Capture("assign", func() {
+				g.Token("IDENT")
+				g.Token("=")
+				g.Call("expr")
+				g.Token(";")
+			})
+		})
+		g.Define("expr").Do(func() {
+			g.Token("IDENT", "NUMBER")
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	ok := parser.testGrammar(
+		[]string{"x=1;", " if (x) y = 2; // done", "a = b;\nif(a)if(b)c=d;"},
+		[]string{"", "x = 1", "x 1;", "if x = 1;", "x = 1; @"},
+	)
+	if !ok {
+		t.Error("token mode test case failed")
+	}
+
+	tree, err := parser.ParseTree("  x = 1 ;  ")
+	if err != nil {
+		t.Fatalf("failed to parse: %v", err)
+	}
+	if n := tree.Root(); n.Name() != "assign" || n.Text(tree) != "x = 1 ;" {
+		t.Errorf("wrong capture: %v %q", n.Name(), n.Text(tree))
+	}
+
+	_, err = parser.ParseTree("x = ;")
+	var f *ParseFailure
+	if !errors.As(err, &f) || f.Column != 5 || fmt.Sprint(f.Expected) != "[IDENT NUMBER]" {
+		t.Errorf("wrong error: %v", err)
+	}
+
+	if _, n, err := parser.ParsePrefix("x = 1; y = 2; @ 3"); err != nil || n != 13 {
+		t.Errorf("input after the prefix shouldn't be lexed: %v %v", n, err)
+	}
+	if _, _, err := parser.ParsePrefix("x = @"); !errors.As(err, &f) || f.Offset != 4 {
+		t.Errorf("lexing @ inside the prefix should fail: %v", err)
+	}
+
+	g := BuildGrammar(func(g *G) {
+		g.Mode = TokenMode(lexer)
+		g.Start = "expr"
+		g.Define("expr").Do(func() {
+			g.Token("STRING")
+		})
+	})
+	if g.Err == nil || !strings.Contains(g.Err.Error(), `Token("STRING") isn't defined in the lexer`) {
+		t.Errorf("unknown token kinds should fail: %v", g.Err)
+	}
+
+	g = BuildGrammar(func(g *G) {
+		g.Mode = TokenMode(lexer)
+		g.Start = "expr"
+		g.Define("expr").Do(func() {
+			g.String("x")
+		})
+	})
+	if g.Err == nil || !strings.Contains(g.Err.Error(), `cannot call String() in token mode`) {
+		t.Errorf("String() should fail in token mode: %v", g.Err)
+	}
+}
+
+func TestRuneClass(t *testing.T) {
+	parser := BuildParser(func(g *G) {
+		g.Start = "stmt"
+		g.Define("stmt").Do(func() {
+			g.Call("ident")
+			g.Rune().Whitespace()
+			g.Call("greek")
+			g.Rune().Whitespace()
+			g.Rune().Class("Nd", "No")
+		})
+		g.Define("ident").Do(func() {
+			g.Rune().IdentStart()
+			g.Repeat().Do(func() {
+				g.Rune().IdentContinue()
+			})
+		})
+		g.Define("greek").Do(func() {
+			g.Repeat().Min(1).Do(func() {
+				g.Rune().Script("Greek")
+			})
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	ok := parser.testGrammar(
+		[]string{"x \u03b1 1", "na\u00efve_2\u3000\u03b1\u03b2\u00a0\u0661", "\u65e5\u672c \u03a9 \u00bd"},
+		[]string{"1x \u03b1 1", "x- \u03b1 1", "x a 1", "x \u03b1 a", "x\u200b\u03b1 1"},
+	)
+	if !ok {
+		t.Error("rune class test case failed")
+	}
+
+	g := BuildGrammar(func(g *G) {
+		g.Define("a").Do(func() {
+			g.Rune().Class("Nope")
+			g.Rune().Script("Klingon")
+			g.Rune().Class()
+		})
+	})
+
+	if g.Err == nil {
+		t.Error("unknown classes should raise error")
+	} else {
+		t.Logf("test grammar raised error:\n %v", g.Err)
+	}
+}
+
+func TestFold(t *testing.T) {
+	var parser *Parser
+	var ok bool
+
+	parser = BuildParser(func(g *G) {
+		g.Start = "stmt"
+		g.Define("stmt").Do(func() {
+			g.MatchStringFold(map[string]func(){
+				"select": func() {
+					g.StringFold("select")
+					g.String(" ")
+					g.Call("hex")
+				},
+				"drop": func() {
+					g.StringFold("drop")
+				},
+				"kelvin": func() {
+					g.StringFold("kelvin")
+				},
+			})
+		})
+		g.Define("hex").Do(func() {
+			g.Repeat().Min(1).Do(func() {
+				g.Rune().RangeFold("0-9", "a-f")
+			})
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	ok = parser.testGrammar(
+		[]string{"select ff", "SELECT 0aF", "Select A", "DROP", "\u212aelvin"},
+		[]string{"selec ff", "select g", "dropp", "delete"},
+	)
+	if !ok {
+		t.Error("fold test case failed")
+	}
+
+	_, err := parser.ParseTree("SELECT x")
+	if err == nil || !strings.Contains(err.Error(), "ignoring case") {
+		t.Errorf("wrong error for bad fold: %v", err)
+	}
+
+	g := BuildGrammar(func(g *G) {
+		g.Define("a").Do(func() {
+			g.MatchStringFold(map[string]func(){
+				"abc": func() { g.String("abc") },
+				"ABC": func() { g.String("ABC") },
+			})
+		})
+	})
+
+	if g.Err == nil {
+		t.Error("duplicate fold keys should raise error")
+	} else {
+		t.Logf("test grammar raised error:\n %v", g.Err)
+	}
+
+	// both look up as many runes as the longest key, not a prefix
+
+	for _, fold := range []bool{false, true} {
+		parser = BuildParser(func(g *G) {
+			g.Start = "a"
+			g.Define("a").Do(func() {
+				cases := map[string]func(){
+					"a": func() {
+						g.String("a")
+					},
+					"ab": func() {
+						g.String("ab")
+					},
+				}
+				if fold {
+					g.MatchStringFold(cases)
+				} else {
+					g.MatchString(cases)
+				}
+				g.Repeat().Do(func() {
+					g.Rune().Range("a-z")
+				})
+			})
+		})
+
+		if parser.Err() != nil {
+			t.Fatalf("error defining grammar:\n%v", parser.Err())
+		}
+
+		ok = parser.testGrammar(
+			[]string{"a", "ab", "abx"},
+			[]string{"ax", "x"},
+		)
+		if !ok {
+			t.Errorf("match string test case failed, fold: %v", fold)
+		}
+	}
+
+	// the grammar checks look inside each case, like "hex" above,
+	// which would otherwise be an unused rule
+
+	g = BuildGrammar(func(g *G) {
+		g.Start = "a"
+		g.Define("a").Do(func() {
+			g.MatchString(map[string]func(){
+				"x": func() {
+					g.String("x")
+					g.Call("missing")
+				},
+			})
+			g.MatchRune(map[rune]func(){
+				'y': func() {
+					g.String("y")
+					g.Backref("name")
+				},
+			})
+		})
+	})
+
+	if g.Err == nil || !strings.Contains(g.Err.Error(), `missing rule "missing"`) ||
+		!strings.Contains(g.Err.Error(), `missing Bind("name")`) {
+		t.Errorf("checks should fire inside match cases: %v", g.Err)
+	}
+
+	g = BuildGrammar(func(g *G) {
+		g.Mode = BinaryMode()
+		g.Define("a").Do(func() {
+			g.StringFold("abc")
+		})
+	})
+
+	if g.Err == nil {
+		t.Error("fold in binary mode should raise error")
+	}
+}
+
+func TestRegexp(t *testing.T) {
+	parser := BuildParser(func(g *G) {
+		g.Start = "number"
+		g.Define("number").Do(func() {
+			g.Capture("number", func() {
+				g.Regexp(`-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?`)
+			})
+			g.Call("suffix?")
+		})
+		g.Define("suffix?").Do(func() {
+			g.Regexp(`[a-z]*`)
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	ok := parser.testGrammar(
+		[]string{"0", "-12.5e+3", "1.0", "12px"},
+		[]string{"", "-", "01", "1.", "1e+", "1 "},
+	)
+	if !ok {
+		t.Error("regexp test case failed")
+	}
+
+	_, err := parser.ParseTree("x")
+	if err == nil || !strings.Contains(err.Error(), "expected /-?(0|") {
+		t.Errorf("wrong error for bad regexp match: %v", err)
+	}
+
+	// a reader buffers at least 64k past the offset, so matches can
+	// cross the end of each read, but can't be longer
+
+	words := BuildParser(func(g *G) {
+		g.Start = "words?"
+		g.Define("words?").Do(func() {
+			g.Repeat().Do(func() {
+				g.Regexp(`[a-z]+`)
+				g.String(";")
+			})
+		})
+	})
+
+	input := strings.Repeat("abcdefg;", 3*readSize/8)
+	if _, err := words.ParseTreeReader(iotest.HalfReader(strings.NewReader(input))); err != nil {
+		t.Errorf("reader failed to parse words: %v", err)
+	}
+
+	input = strings.Repeat("a", readSize+10) + ";"
+	if _, err := words.ParseTree(input); err != nil {
+		t.Errorf("failed to parse long word: %v", err)
+	}
+	if _, err := words.ParseTreeReader(strings.NewReader(input)); err == nil {
+		t.Error("reader should cut a long match short")
+	}
+
+	g := BuildGrammar(func(g *G) {
+		g.Define("a").Do(func() {
+			g.Regexp(`a(`)
+			g.Regexp(`a\nb`)
+		})
+	})
+
+	if g.Err == nil {
+		t.Error("bad regexps should raise error")
+	} else {
+		t.Logf("test grammar raised error:\n %v", g.Err)
+	}
+
+	for _, pattern := range []string{`\r?\n`, `a\tb`, `x\r\ny`} {
+		g = BuildGrammar(func(g *G) {
+			g.Define("a").Do(func() {
+				g.Regexp(pattern)
+			})
+		})
+		if g.Err == nil || !strings.Contains(g.Err.Error(), "reserved string") {
+			t.Errorf("regexp %q containing reserved strings gave %v", pattern, g.Err)
+		}
+	}
+
+	// classes aren't checked, like Rune() and Rune().Except()
+
+	for _, pattern := range []string{`a\sb`, `[\n\t]`, `(?s).`, `.`, `[^']`} {
+		g = BuildGrammar(func(g *G) {
+			g.Define("a").Do(func() {
+				g.Regexp(pattern)
+			})
+		})
+		if g.Err != nil {
+			t.Errorf("regexp %q with a class raised error:\n%v", pattern, g.Err)
+		}
+	}
+
+	g = BuildGrammar(func(g *G) {
+		g.Mode = BinaryMode()
+		g.Define("a").Do(func() {
+			g.Regexp(`a`)
+		})
+	})
+
+	if g.Err == nil {
+		t.Error("regexp in binary mode should raise error")
+	}
+
+	g = BuildGrammar(func(g *G) {
+		g.Define("a").Do(func() {
+			g.Regexp(`a*`)
+		})
+	})
+
+	if g.Err == nil {
+		t.Error("nullable regexp should raise error")
+	}
+}
+
+func TestParseReader(t *testing.T) {
+	var parser *Parser
+
+	parser = BuildParser(func(g *G) {
+		g.Start = "lines?"
+		g.Define("lines?").Do(func() {
+			g.Repeat().Do(func() {
+				g.Call("line")
+			})
+		})
+		g.Define("line").Do(func() {
+			g.Choice(func() {
+				g.String("#")
+				g.Cut()
+				g.Repeat().Do(func() {
+					g.Rune().Except("\n")
+				})
+			}, func() {
+				g.Capture("key", func() {
+					g.Repeat().Min(1).Do(func() {
+						g.Rune().Range("a-z")
+					})
+				})
+				g.String("=")
+				g.Capture("value", func() {
+					g.Repeat().Do(func() {
+						g.Rune().Range("0-9")
+					})
+				})
+			})
+			g.Newline()
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	input := "# numbers\none=1\ntwo=2\n# more\nthree=3\n"
+	tree, err := parser.ParseTreeReader(iotest.OneByteReader(strings.NewReader(input)))
+	if err != nil {
+		t.Fatalf("reader failed to parse:\n%v", err)
+	}
+	want, _ := parser.ParseTree(input)
+
+	var got, expected []string
+	tree.Walk(func(n *Node) { got = append(got, tree.text(n)) })
+	want.Walk(func(n *Node) { expected = append(expected, want.text(n)) })
+
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("reader parse tree differs: %q vs %q", got, expected)
+	}
+
+	_, err = parser.ParseTreeReader(strings.NewReader("one=1\ntwo=x\n"))
+	var f *ParseFailure
+	if !errors.As(err, &f) || f.Line != 2 || f.Column != 5 {
+		t.Errorf("wrong error for bad input: %v", err)
+	} else {
+		t.Logf("reader failure:\n%v", f.Format())
+	}
+
+	readErr := errors.New("read failed")
+	_, err = parser.ParseTreeReader(iotest.TimeoutReader(iotest.OneByteReader(strings.NewReader(input))))
+	if err != iotest.ErrTimeout {
+		t.Errorf("expected read error, got %v", err)
+	}
+	_, err = parser.ParseReader(iotest.ErrReader(readErr))
+	if err != readErr {
+		t.Errorf("expected read error, got %v", err)
+	}
+
+	// without captures, the input is thrown away as it is parsed
+
+	parser = BuildParser(func(g *G) {
+		g.Start = "comments?"
+		g.Define("comments?").Do(func() {
+			g.Repeat().Choice(func() {
+				g.String("#")
+				g.Cut()
+				g.Repeat().Do(func() {
+					g.Rune().Except("\n")
+				})
+				g.Newline()
+			}, func() {
+				g.Newline()
+			})
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	line := "# " + strings.Repeat("x", 1000) + "\n"
+	input = strings.Repeat(line, 2000)
+	state := parser.newReaderState(strings.NewReader(input))
+	rule := parser.rules[parser.config.startIdx]
+
+	if !rule(state) || !atEnd(state) {
+		t.Fatal("reader failed to parse comments")
+	}
+	if len(state.i.buf) > 4*readSize {
+		t.Errorf("reader kept %v bytes of %v", len(state.i.buf), len(input))
+	}
+
+	// the tree keeps all of the input, but each record from ParseEach
+	// is thrown away once it has been handled
+
+	parser = BuildParser(func(g *G) {
+		g.Start = "records?"
+		g.Define("records?").Do(func() {
+			g.Repeat().Do(func() {
+				g.Call("record")
+			})
+		})
+		g.Define("record").Do(func() {
+			g.Capture("record", func() {
+				g.Capture("key", func() {
+					g.Repeat().Min(1).Do(func() {
+						g.Rune().Range("a-z")
+					})
+				})
+				g.String("=")
+				g.Capture("value", func() {
+					g.Repeat().Do(func() {
+						g.Rune().Range("0-9")
+					})
+				})
+			})
+			g.Newline()
+			g.Predicate(func(m *MatchContext) bool {
+				// outside a capture, the text starts at the record
+				return strings.HasPrefix(m.Text(), "kkkkk")
+			})
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	var records strings.Builder
+	for i := 0; i < 20000; i++ {
+		fmt.Fprintf(&records, "%v=%v\n", strings.Repeat("k", 50+i%50), i)
+	}
+	tree, err = parser.ParseTreeReader(strings.NewReader(records.String()))
+	if err != nil {
+		t.Fatalf("reader failed to parse records:\n%v", err)
+	}
+	if tree.Root().Text(tree) != records.String() {
+		t.Errorf("reader tree lost input, got %v bytes of %v", len(tree.Root().Text(tree)), records.Len())
+	}
+
+	children := tree.Children(tree.Root())
+	if len(children) != 20000 {
+		t.Fatalf("wrong number of records: %v", len(children))
+	}
+	head, tail := children[0].Text(tree), children[len(children)-1].Text(tree)
+	if head != strings.Repeat("k", 50)+"=0" || tail != strings.Repeat("k", 99)+"=19999" {
+		t.Errorf("wrong records: %q, %q", head, tail)
+	}
+
+	count, buffered := 0, 0
+	err = parser.ParseEach(strings.NewReader(records.String()), "record", func(tree *ParseTree) error {
+		if len(tree.buf) > buffered {
+			buffered = len(tree.buf)
+		}
+		if want := fmt.Sprintf("%v=%v", strings.Repeat("k", 50+count%50), count); tree.Root().Text(tree) != want {
+			return fmt.Errorf("record %v is %q", count, tree.Root().Text(tree))
+		}
+		count++
+		return nil
+	})
+	if err != nil || count != 20000 {
+		t.Fatalf("failed to parse each record, got %v: %v", count, err)
+	}
+	if buffered > 4*readSize {
+		t.Errorf("reader kept %v bytes of %v", buffered, records.Len())
+	}
+}
+
+func TestParseEach(t *testing.T) {
+	var parser *Parser
+
+	parser = BuildParser(func(g *G) {
+		g.Start = "file?"
+		g.Define("file?").Do(func() {
+			g.Repeat().Choice(func() {
+				g.Call("record")
+			}, func() {
+				g.Call("blank?")
+			})
+		})
+		g.Define("record").Do(func() {
+			g.Capture("key", func() {
+				g.Repeat().Min(1).Do(func() {
+					g.Rune().Range("a-z")
+				})
+			})
+			g.String("=")
+			g.Capture("value", func() {
+				g.Repeat().Do(func() {
+					g.Rune().Range("0-9")
+				})
+			})
+			g.Newline()
+		})
+		g.Define("blank?").Do(func() {
+			g.Optional().Do(func() {
+				g.Newline()
+			})
+		})
+	})
+
+	if parser.Err() != nil {
+		t.Fatalf("error defining grammar:\n%v", parser.Err())
+	}
+
+	var records []string
+	err := parser.ParseEach(strings.NewReader("one=1\ntwo=2\nthree=3\n"), "record", func(tree *ParseTree) error {
+		var texts []string
+		tree.Walk(func(n *Node) { texts = append(texts, tree.text(n)) })
+		records = append(records, strings.Join(texts, " "))
+		if len(tree.nodes) != 3 {
+			t.Errorf("record has %v nodes", len(tree.nodes))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("failed to parse records:\n%v", err)
+	}
+	if fmt.Sprint(records) != fmt.Sprint([]string{"one 1 one=1\n", "two 2 two=2\n", "three 3 three=3\n"}) {
+		t.Errorf("wrong records: %q", records)
+	}
+
+	// line numbers are for the whole input
+
+	count := 0
+	err = parser.ParseEach(strings.NewReader("one=1\ntwo=2\nthree=x\n"), "record", func(tree *ParseTree) error {
+		count++
+		return nil
+	})
+	var f *ParseFailure
+	if !errors.As(err, &f) || f.Line != 3 || f.Column != 7 || count != 2 {
+		t.Errorf("wrong error for bad record: %v", err)
+	}
+
+	stop := errors.New("stop")
+	err = parser.ParseEach(strings.NewReader("one=1\ntwo=2\n"), "record", func(tree *ParseTree) error {
+		return stop
+	})
+	if err != stop {
+		t.Errorf("expected callback error, got %v", err)
+	}
+
+	err = parser.ParseEach(strings.NewReader("\n\n"), "blank?", func(tree *ParseTree) error {
+		return nil
+	})
+	if err != nil {
+		t.Errorf("blank lines failed to parse: %v", err)
+	}
+
+	err = parser.ParseEach(strings.NewReader("x"), "blank?", func(tree *ParseTree) error {
+		return nil
+	})
+	if !errors.Is(err, ParseError) {
+		t.Errorf("empty record should fail, got %v", err)
+	}
+
+	err = parser.ParseEach(strings.NewReader(""), "missing", func(tree *ParseTree) error {
+		return nil
+	})
+	if err == nil {
+		t.Error("missing rule should fail")
+	}
+}
+
+func TestBlockIndent(t *testing.T) {
+	var parser *Parser
+	var ok bool
+
+	parser = BuildParser(func(g *G) {
+		g.Start = "expr"
+		g.Mode = TextMode().Tabstop(8)
+		g.Define("expr").Do(func() {
+			g.Choice(func() {
+				g.String("block:")
+				g.Newline()
+				g.IndentedBlock(func() {
+					g.Repeat().Do(func() {
+						g.Indent()
+						g.Call("expr")
+					})
+				})
+			}, func() {
+				g.String("row")
+				g.Newline()
+			})
+		})
+
+	})
+
+	if parser.Err() != nil {
+		t.Errorf("error defining grammar:\n%v", parser.Err())
+	} else {
+		ok = parser.testRule("expr",
+			[]string{}, // "block:\n row\n", "block:\n row\n row\n row\n", "block:\n block:\n  row\n"},
+			[]string{
+				"", "block:\nrow\n\n", "\n row",
+				"block:\n row\n row\n  row\n",
+				"block:\nblock:\n  row\n",
+				"block:\nxrow\n",
+			},
+		)
+		if !ok {
+			t.Error("indent test case failed")
+		}
+	}
+}
+
+func TestOffsideIndent(t *testing.T) {
+	var parser *Parser
+	var ok bool
+
+	parser = BuildParser(func(g *G) {
+		g.Start = "expr"
+		g.Mode = TextMode().Tabstop(8)
+		g.Define("expr").Do(func() {
+			g.Choice(func() {
+				g.Choice(func() {
+					g.String("do")
+				}, func() {
+					g.String("let")
+				})
+
+				g.OffsideBlock(func() {
+					g.Whitespace()
+					g.Newline()
+					g.Repeat().Do(func() {
+						g.Indent()
+						g.Call("expr")
+					})
+				})
+			}, func() {
+				g.String("row")
+				g.Newline()
+			})
+		})
+
+	})
+
+	if parser.Err() != nil {
+		t.Errorf("error defining grammar:\n%v", parser.Err())
+	} else {
+		ok = parser.testRule("expr",
+			[]string{"row\n", "do\n  row\n", "let\n   row\n   row\n   row\n", "do\n  let\n     row\n"},
+			[]string{"", "do\nrow\n", "do\nxxrow\n", "\nrow", "do\n  let\n    row\n"},
+		)
+		if !ok {
+			t.Error("indent test case failed")
+		}
+	}
+}
+
+func TestTabStop(t *testing.T) {
+	var parser *Parser
+	var ok bool
+
+	parser = BuildParser(func(g *G) {
+		g.Start = "expr"
+		g.Mode = TextMode().Tabstop(8)
+		g.Define("expr").Do(func() {
+			g.Whitespace().Width(4)
+			g.Whitespace().Width(5)
+			g.String("hello")
+		})
+
+	})
+
+	if parser.Err() != nil {
+		t.Errorf("error defining grammar:\n%v", parser.Err())
+	} else {
+		ok = parser.testRule("expr",
+			[]string{
+				"\t hello",
+				" \t hello",
+				"  \t hello",
+				"   \t hello",
+				"    \t hello",
+				"     \t hello",
+				"      \t hello",
+				"       \t hello",
+				"         hello",
+			},
+			[]string{
+				" hello",
+				"\thello",
+				"        \thello",
+			},
+		)
+		if !ok {
+			t.Error("tab test case failed")
+		}
 	}
 }
 
@@ -1070,3 +3498,112 @@ func BenchmarkParser(b *testing.B) {
 		b.Error("print test case failed to parse")
 	}
 }
+
+func TestWriteGrammar(t *testing.T) {
+	g := BuildGrammar(func(g *G) {
+		g.Start = "list"
+		g.Define("list").Do(func() {
+			g.Capture("list", func() {
+				g.String("[")
+				g.Optional().Do(func() {
+					g.Call("item")
+					g.Repeat().Do(func() {
+						g.String(",")
+						g.Call("item")
+					})
+				})
+				g.String("]")
+			})
+		})
+		g.Define("item").Choice(func() {
+			g.Reject(func() {
+				g.StringFold("null")
+			})
+			g.Repeat().MinMax(1, 3).Do(func() {
+				g.Rune().Range("a-z")
+			})
+		}, func() {
+			g.Lookahead(func() {
+				g.String("'")
+			})
+			g.Regexp(`'[^']*'`)
+		}, func() {
+			g.Call("digits")
+		}, func() {
+			g.Call("expr")
+		}, func() {
+			g.Call("not-quote")
+		})
+		g.Define("not-quote").Do(func() {
+			g.Reject(func() {
+				g.String("'")
+			})
+			g.Rune()
+		})
+		g.Define("digits").Do(func() {
+			g.MatchString(map[string]func(){
+				"1": func() {
+					g.String("1")
+				},
+				"2": func() {
+					g.String("22")
+				},
+			})
+			g.MatchRune(map[rune]func(){
+				'+': func() {
+					g.String("+")
+				},
+				'-': func() {
+					g.String("-")
+				},
+			})
+		})
+		g.Define("expr").Recursive("expr").Choice(func() {
+			g.Corner("expr", 1)
+			g.Recur("expr")
+			g.String("+", "-")
+			g.Stump("expr")
+		}, func() {
+			g.NoCorner("expr", 2)
+			g.Repeat().Min(1).Do(func() {
+				g.Rune().Range("0-9")
+			})
+		})
+	})
+
+	if g.Err != nil {
+		t.Fatalf("error defining grammar:\n%v", g.Err)
+	}
+
+	var peg strings.Builder
+	if err := g.WritePEG(&peg); err != nil {
+		t.Fatal(err)
+	}
+	wantPEG := `# Start
+list <- list:( "[" ( item ( "," item )* )? "]" )
+item <- !"null"i [a-z]{1,3} / &"'" /'[^']*'/ / digits / expr / not-quote
+not-quote <- !"'" .
+digits <- ( &"1" "1" / &"2" "22" ) ( &"+" "+" / &"-" "-" )
+# Recursive(expr)
+expr <- @Corner(expr, 1) expr ( "+" / "-" ) expr / @NoCorner(expr, 2) [0-9]+
+`
+	if peg.String() != wantPEG {
+		t.Errorf("wrong peg:\n%v", peg.String())
+	}
+
+	var ebnf strings.Builder
+	if err := g.WriteEBNF(&ebnf); err != nil {
+		t.Fatal(err)
+	}
+	wantEBNF := `(* Start *)
+list = ( "[" , [ item , { "," , item } ] , "]" ) (* capture list *) ;
+item = ? not followed by "null" ignoring case ? , ? [a-z] ? , 2 * [ ? [a-z] ? ] | ? followed by "'" ? , ? regexp /'[^']*'/ ? | digits | expr | not quote ;
+not quote = ? any character ? - "'" ;
+digits = ( ? followed by "1" ? , "1" | ? followed by "2" ? , "22" ) , ( ? followed by "+" ? , "+" | ? followed by "-" ? , "-" ) ;
+(* Recursive(expr) *)
+expr = ? Corner(expr, 1) ? , expr , ( "+" | "-" ) , expr | ? NoCorner(expr, 2) ? , ? [0-9] ? , { ? [0-9] ? } ;
+`
+	if ebnf.String() != wantEBNF {
+		t.Errorf("wrong ebnf:\n%v", ebnf.String())
+	}
+}
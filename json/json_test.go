@@ -36,4 +36,12 @@ func TestJson(t *testing.T) {
 	} else {
 		t.Logf("Output: %v", out2)
 	}
+
+	out3, err := JsonParser.ParseRule("value", `"bare"`)
+
+	if err != nil {
+		t.Error("bad json value parse: ", err)
+	} else if v, ok := out3.(*string); !ok || *v != "bare" {
+		t.Errorf("bad json value: %v", out3)
+	}
 }
@@ -1,6 +1,7 @@
 package yaml
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 
@@ -76,3 +77,21 @@ func TestYaml(t *testing.T) {
 	}
 
 }
+
+func TestYamlError(t *testing.T) {
+	_, err := YamlParser.Parse("a: [1, 2\nb: 3\n")
+
+	var f *ez.ParseFailure
+
+	if err == nil {
+		t.Fatal("bad yaml should not parse")
+	} else if !errors.As(err, &f) {
+		t.Fatalf("expected a parse failure, got %v", err)
+	}
+
+	t.Logf("Error:\n%v", f.Format())
+
+	if f.Line != 1 || f.Column != 9 {
+		t.Errorf("wrong position, got line %v, col %v", f.Line, f.Column)
+	}
+}